@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/internal/config"
+	"github.com/i5heu/PathfinderBeacon/pkg/dnssec"
+	"github.com/miekg/dns"
+)
+
+// runDNSSECCommand handles "server dnssec keygen" and "server dnssec ds".
+func runDNSSECCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: server dnssec keygen|ds [flags]")
+	}
+
+	switch args[0] {
+	case "keygen":
+		fs := flag.NewFlagSet("dnssec keygen", flag.ContinueOnError)
+		zoneName := fs.String("zone", "", "zone apex the key is for")
+		algorithm := fs.String("algorithm", "ecdsa-p256", "ecdsa-p256 or ed25519")
+		ksk := fs.Bool("ksk", false, "create a key signing key (SEP flag)")
+		dir := fs.String("dir", ".", "directory for the key files")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *zoneName == "" {
+			return fmt.Errorf("-zone is required")
+		}
+
+		path, err := dnssec.GenerateKey(*zoneName, *algorithm, *ksk, *dir)
+		if err != nil {
+			return err
+		}
+		fmt.Println(path)
+		return nil
+
+	case "ds":
+		// takes the same flags as the server to find the config
+		cfg, _, err := config.Load(args[1:])
+		if err != nil {
+			return err
+		}
+
+		signers, err := newSigners(cfg)
+		if err != nil {
+			return err
+		}
+		if len(signers) == 0 {
+			return fmt.Errorf("No zone has dnssec keys configured")
+		}
+		for _, z := range cfg.Zones {
+			if signer, ok := signers[z.Apex]; ok {
+				fmt.Println(signer.DS(dns.SHA256).String())
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("Unknown dnssec command %q, use keygen or ds", args[0])
+	}
+}
+
+// newSigners loads the DNSSEC keys of all signed zones.
+func newSigners(cfg *config.Config) (map[string]*dnssec.Signer, error) {
+	signers := make(map[string]*dnssec.Signer)
+	for _, z := range cfg.Zones {
+		if !z.DNSSEC.Enabled() {
+			continue
+		}
+		signer, err := dnssec.NewSigner(z.Apex, z.DNSSEC.KSK, z.DNSSEC.ZSK, time.Duration(z.DNSSEC.Validity))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load dnssec keys of %s: %v", z.Apex, err)
+		}
+		signers[signer.Zone()] = signer
+	}
+	return signers, nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"encoding/base64"
+
+	"github.com/i5heu/PathfinderBeacon/internal/config"
+)
+
+// federationPeers returns the URLs and the decoded secrets of the federation peers, the secrets are checked by config.Validate.
+func federationPeers(cfg config.FederationConfig) ([]string, [][]byte) {
+	urls := make([]string, 0, len(cfg.Peers))
+	secrets := make([][]byte, 0, len(cfg.Peers))
+	for _, peer := range cfg.Peers {
+		secret, _ := base64.StdEncoding.DecodeString(peer.Secret)
+		urls = append(urls, peer.URL)
+		secrets = append(secrets, secret)
+	}
+	return urls, secrets
+}
@@ -3,18 +3,22 @@ package main
 import (
 	// "crypto/tls"
 
+	"context"
+	"encoding/base64"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
-
-	// "os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/i5heu/PathfinderBeacon/internal/config"
 	"github.com/i5heu/PathfinderBeacon/internal/logg"
 	"github.com/i5heu/PathfinderBeacon/internal/reqLogic"
 	"github.com/i5heu/PathfinderBeacon/pkg/cache"
 	"github.com/i5heu/PathfinderBeacon/pkg/rate_limiter"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
 	"go.uber.org/zap"
 	// "golang.org/x/crypto/acme/autocert"
 )
@@ -22,75 +26,195 @@ import (
 var logger *zap.Logger
 
 func main() {
-	logger = logg.InitLogger()
+	if len(os.Args) > 1 && os.Args[1] == "dnssec" {
+		if err := runDNSSECCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		if err := runSnapshotCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, printConfig, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	logger = logg.InitLogger(cfg.Log.Path, cfg.Log.Level)
 	defer logger.Sync()
 
-	// get env example room name
-	demoRoomName := os.Getenv("DEMO_ROOM_NAME")
-	if demoRoomName == "" {
-		demoRoomName = "NoDemoRoomName"
+	zones := make([]*zone.Zone, 0, len(cfg.Zones))
+	for _, zc := range cfg.Zones {
+		z := zone.New(zc.Apex, zc.Nameservers, zc.Hostmaster)
+		if err := loadStaticRecords(z, zc, cfg.TTL.Static); err != nil {
+			log.Fatal(err)
+		}
+		zones = append(zones, z)
+	}
+
+	signers, err := newSigners(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cacheStore, err := cache.NewStore(cfg.Cache.Backend, cfg.Cache.SizeMB, cfg.Cache.Path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cacheStore.Close()
+
+	if cfg.Snapshot.Path != "" {
+		restored, err := cache.LoadSnapshot(cacheStore, cfg.Snapshot.Path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Info("Restored snapshot", zap.String("path", cfg.Snapshot.Path), zap.Int("keys", restored))
+		go saveSnapshots(cacheStore, cfg.Snapshot.Path, time.Duration(cfg.Snapshot.Interval))
+	}
+
+	rateLimitStoreUDP, err := rate_limiter.NewRateLimiter(cfg.RateLimit.UDP.Tokens, time.Duration(cfg.RateLimit.UDP.Interval))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	cacheStore := cache.NewCache(1000 * 1024 * 1024)
-	defer cacheStore.Ticker.Stop()
+	globalRateLimitStoreUDP, err := rate_limiter.NewRateLimiter(cfg.RateLimit.GlobalUDP.Tokens, time.Duration(cfg.RateLimit.GlobalUDP.Interval))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	rateLimitStoreUDP, err := rate_limiter.NewRateLimiter(20, time.Minute*1)
+	rateLimitStoreTCP, err := rate_limiter.NewRateLimiter(cfg.RateLimit.TCP.Tokens, time.Duration(cfg.RateLimit.TCP.Interval))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	globalRateLimitStoreUDP, err := rate_limiter.NewRateLimiter(300, time.Minute*1)
+	registerLimits, err := rate_limiter.NewRateLimiter(cfg.RateLimit.Register.Tokens, time.Duration(cfg.RateLimit.Register.Interval))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	rateLimitStoreTCP, err := rate_limiter.NewRateLimiter(500, time.Minute*5)
+	federationLimits, err := rate_limiter.NewRateLimiter(cfg.Federation.RateLimit.Tokens, time.Duration(cfg.Federation.RateLimit.Interval))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	tmpl, err := template.ParseFiles("template/index.tmpl")
+	secrets, notifyAlgorithm := tsigSecrets(cfg.Transfer)
+	replicationSecret, _ := base64.StdEncoding.DecodeString(cfg.Replication.Secret)
+	federationPeers, federationSecrets := federationPeers(cfg.Federation)
+
+	tmpl, err := template.ParseFiles(cfg.Template)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
-	handler := reqLogic.NewDNSHandler(rateLimitStoreTCP, rateLimitStoreUDP, globalRateLimitStoreUDP, cacheStore, logger, demoRoomName, tmpl)
+	handler := reqLogic.NewDNSHandler(rateLimitStoreTCP, rateLimitStoreUDP, globalRateLimitStoreUDP, cacheStore, logger, tmpl, reqLogic.Settings{
+		DemoRoomName:    cfg.DemoRoom,
+		Zones:           zone.NewZones(zones...),
+		RoomTTL:         cfg.TTL.Room,
+		NodeTTL:         cfg.TTL.Node,
+		StaticTTL:       cfg.TTL.Static,
+		NegativeTTL:     cfg.TTL.Negative,
+		RegistrationTTL: cfg.TTL.Registration,
+
+		AllowV1Registration: cfg.Register.AllowV1,
+		MaxClockSkew:        time.Duration(cfg.Register.MaxClockSkew),
+		NonceCacheSize:      cfg.Register.NonceCacheSize,
+		RegisterLimits:      registerLimits,
+
+		Signers: signers,
+
+		UDPSize:        cfg.EDNS.UDPSize,
+		CookieRotation: time.Duration(cfg.EDNS.CookieRotation),
+
+		UDPListsNeedCookie: cfg.EDNS.UDPListsNeedCookie,
+
+		TransferAllowFrom: transferACL(cfg.Transfer),
+		TSIGSecrets:       secrets,
+		Secondaries:       cfg.Transfer.Secondaries,
+		NotifyKey:         cfg.Transfer.NotifyKey,
+		NotifyAlgorithm:   notifyAlgorithm,
+		JournalSize:       cfg.Transfer.JournalSize,
+
+		ReplicationPeers:  cfg.Replication.Peers,
+		ReplicationSecret: replicationSecret,
+
+		FederationPeers:       federationPeers,
+		FederationSecrets:     federationSecrets,
+		FederationMaxLifetime: time.Duration(cfg.Federation.MaxLifetime),
+		FederationLimits:      federationLimits,
+	})
+
+	go handler.StartPruner(time.Minute)
+	go handler.StartNotifier(time.Second)
+	go reloadStaticRecordsOnSIGHUP(zones, handler)
+	go handler.StartReplication(time.Second, time.Duration(cfg.Replication.Interval))
+	go handler.StartFederation(time.Second, time.Duration(cfg.Federation.Interval))
 
 	go func() {
-		reqLogic.StartDnsUdpServer(handler)
+		reqLogic.StartDnsUdpServer(handler, cfg.Listen.DNS)
 	}()
 
 	go func() {
-		reqLogic.StartDnsTcpServer(handler)
+		reqLogic.StartDnsTcpServer(handler, cfg.Listen.DNS)
 	}()
 
+	if cfg.Listen.DoT != "" {
+		go func() {
+			reqLogic.StartDnsTlsServer(handler, cfg.Listen.DoT, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		}()
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/register", handler.RegisterNodeHandler)
-	mux.HandleFunc("/", handler.LandingPage)
-
-	port := ":8088"
-	if IsProductionMode() {
-		port = ":80"
+	mux.HandleFunc("/deregister", handler.DeregisterNodeHandler)
+	mux.HandleFunc("/dns-query", handler.DoHHandler)
+	mux.HandleFunc("GET /v1/rooms/{room}", handler.RoomLookupHandler)
+	mux.HandleFunc("GET /v1/rooms/{room}/watch", handler.WatchRoomHandler)
+	mux.HandleFunc("GET /v1/nodes/{node}", handler.NodeLookupHandler)
+	if len(cfg.Replication.Peers) > 0 {
+		mux.HandleFunc("POST /v1/replication/push", handler.ReplicationPushHandler)
+		mux.HandleFunc("GET /v1/replication/state", handler.ReplicationStateHandler)
+	}
+	if len(cfg.Federation.Peers) > 0 {
+		mux.HandleFunc("/v1/federation/records", handler.FederationRecordsHandler)
 	}
+	mux.HandleFunc("/", handler.LandingPage)
 
 	httpServer := &http.Server{
-		Addr:    port,
+		Addr:    cfg.Listen.HTTP,
 		Handler: mux,
 	}
 
-	log.Println("Starting HTTP server on port ", port, "...")
+	// stop the HTTP server on SIGINT and SIGTERM, so the last snapshot is saved
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		logger.Info("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+	}()
+
+	log.Println("Starting HTTP server on ", cfg.Listen.HTTP, "...")
 	err = httpServer.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start HTTP server: %s\n", err)
 	}
 
-	if err != nil {
-		log.Fatalf("Failed to start HTTPS server: %s\n", err)
+	if cfg.Snapshot.Path != "" {
+		saveSnapshot(cacheStore, cfg.Snapshot.Path)
 	}
 }
-
-func IsProductionMode() bool {
-	prod := os.Getenv("PROD_MODE")
-	return (prod == "true")
-}
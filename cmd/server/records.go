@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/i5heu/PathfinderBeacon/internal/config"
+	"github.com/i5heu/PathfinderBeacon/internal/reqLogic"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"go.uber.org/zap"
+)
+
+// loadStaticRecords parses the records of the config and the zone file and replaces the records of z.
+func loadStaticRecords(z *zone.Zone, zc config.ZoneConfig, ttl uint32) error {
+	records, err := z.ParseRecords(zc.Records, ttl)
+	if err != nil {
+		return err
+	}
+
+	if zc.ZoneFile != "" {
+		if err := records.LoadFile(z, zc.ZoneFile, ttl); err != nil {
+			return err
+		}
+	}
+
+	z.SetRecords(records)
+	return nil
+}
+
+// reloadStaticRecordsOnSIGHUP reads the config again on SIGHUP and reloads the static records
+// of the zones. Zones that fail to load keep their old records, new zones need a restart.
+// The SOA serial is increased, so secondaries transfer the new records.
+func reloadStaticRecordsOnSIGHUP(zones []*zone.Zone, handler *reqLogic.ReqLogic) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		cfg, _, err := config.Load(os.Args[1:])
+		if err != nil {
+			logger.Error("Failed to reload config", zap.Error(err))
+			continue
+		}
+
+		for _, z := range zones {
+			found := false
+			for _, zc := range cfg.Zones {
+				if zc.Apex != z.Apex {
+					continue
+				}
+				found = true
+
+				if err := loadStaticRecords(z, zc, cfg.TTL.Static); err != nil {
+					logger.Error("Failed to reload static records", zap.String("zone", z.Apex), zap.Error(err))
+					continue
+				}
+				logger.Info("Reloaded static records", zap.String("zone", z.Apex), zap.Int("records", len(z.Records().All())))
+			}
+			if !found {
+				logger.Warn("Zone was removed from the config, restart to remove it", zap.String("zone", z.Apex))
+			}
+		}
+		handler.ZonesChanged()
+	}
+}
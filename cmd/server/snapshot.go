@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/internal/config"
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"go.uber.org/zap"
+)
+
+// runSnapshotCommand handles "server snapshot export <file>" and "server snapshot import <file>".
+// They work on the configured storage backend and snapshot file, so the server should be stopped.
+// "-" is stdout or stdin.
+func runSnapshotCommand(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Usage: server snapshot export|import <file> [server flags]")
+	}
+
+	// takes the same flags as the server to find the config
+	cfg, _, err := config.Load(args[2:])
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "import" && cfg.Cache.Backend != cache.BackendBolt && cfg.Snapshot.Path == "" {
+		return fmt.Errorf("The %s backend does not keep data, set snapshot.path or use the bolt backend", cfg.Cache.Backend)
+	}
+
+	store, err := cache.NewStore(cfg.Cache.Backend, cfg.Cache.SizeMB, cfg.Cache.Path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// the in-memory backends start with the last snapshot, like the server
+	if cfg.Snapshot.Path != "" {
+		if _, err := cache.LoadSnapshot(store, cfg.Snapshot.Path); err != nil {
+			return err
+		}
+	}
+
+	switch args[0] {
+	case "export":
+		out := os.Stdout
+		if args[1] != "-" {
+			out, err = os.Create(args[1])
+			if err != nil {
+				return fmt.Errorf("Failed to create %s: %v", args[1], err)
+			}
+			defer out.Close()
+		}
+
+		snapshot := cache.TakeSnapshot(store, time.Now())
+		if err := snapshot.Write(out); err != nil {
+			return fmt.Errorf("Failed to write snapshot: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d keys\n", len(snapshot.Keys))
+		return nil
+
+	case "import":
+		var in io.Reader = os.Stdin
+		if args[1] != "-" {
+			file, err := os.Open(args[1])
+			if err != nil {
+				return fmt.Errorf("Failed to open %s: %v", args[1], err)
+			}
+			defer file.Close()
+			in = file
+		}
+
+		snapshot, err := cache.ReadSnapshot(in)
+		if err != nil {
+			return err
+		}
+		restored, err := snapshot.Restore(store, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if cfg.Snapshot.Path != "" {
+			if _, err := cache.SaveSnapshot(store, cfg.Snapshot.Path); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d keys\n", restored)
+		return nil
+
+	default:
+		return fmt.Errorf("Unknown snapshot command %q, use export or import", args[0])
+	}
+}
+
+// saveSnapshots writes a snapshot of store to path every interval.
+func saveSnapshots(store cache.Store, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		saveSnapshot(store, path)
+	}
+}
+
+func saveSnapshot(store cache.Store, path string) {
+	keys, err := cache.SaveSnapshot(store, path)
+	if err != nil {
+		logger.Error("Failed to save snapshot", zap.String("path", path), zap.Error(err))
+		return
+	}
+	logger.Debug("Saved snapshot", zap.String("path", path), zap.Int("keys", keys))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+
+	"github.com/i5heu/PathfinderBeacon/internal/config"
+)
+
+// transferACL returns the networks of transfer.allowFrom, the CIDRs are checked by config.Validate.
+func transferACL(cfg config.TransferConfig) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cfg.AllowFrom {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// tsigSecrets returns the TSIG secrets by key name and the algorithm of the notify key.
+func tsigSecrets(cfg config.TransferConfig) (map[string]string, string) {
+	secrets := make(map[string]string, len(cfg.TSIGKeys))
+	notifyAlgorithm := ""
+	for _, key := range cfg.TSIGKeys {
+		secrets[key.Name] = key.Secret
+		if key.Name == cfg.NotifyKey {
+			notifyAlgorithm = key.Algorithm
+		}
+	}
+	return secrets, notifyAlgorithm
+}
@@ -5,6 +5,8 @@ go 1.22.3
 require (
 	github.com/miekg/dns v1.1.59
 	github.com/sethvargo/go-limiter v1.0.0
+	go.etcd.io/bbolt v1.3.10
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/sync v0.7.0 // indirect
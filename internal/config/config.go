@@ -0,0 +1,697 @@
+package config
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Listen      ListenConfig      `yaml:"listen"`
+	TLS         TLSConfig         `yaml:"tls"`
+	Zones       []ZoneConfig      `yaml:"zones"`
+	TTL         TTLConfig         `yaml:"ttl"`
+	EDNS        EDNSConfig        `yaml:"edns"`
+	Transfer    TransferConfig    `yaml:"transfer"`
+	RateLimit   RateLimitConfig   `yaml:"rateLimit"`
+	Cache       CacheConfig       `yaml:"cache"`
+	Snapshot    SnapshotConfig    `yaml:"snapshot"`
+	Replication ReplicationConfig `yaml:"replication"`
+	Federation  FederationConfig  `yaml:"federation"`
+	Register    RegisterConfig    `yaml:"registration"`
+	Log         LogConfig         `yaml:"log"`
+	DemoRoom    string            `yaml:"demoRoom"`
+	Template    string            `yaml:"template"`
+}
+
+type ListenConfig struct {
+	HTTP string `yaml:"http"`
+	DNS  string `yaml:"dns"` // used for UDP and TCP
+	DoT  string `yaml:"dot"` // DNS over TLS, disabled if empty
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"` // reloaded when it changes
+	KeyFile  string `yaml:"keyFile"`
+}
+
+type ZoneConfig struct {
+	Apex        string   `yaml:"apex"`
+	Nameservers []string `yaml:"nameservers"`
+	Hostmaster  string   `yaml:"hostmaster"`
+	Records     []string `yaml:"records"`            // static records in master file format, e.g. "www A 192.0.2.1"
+	ZoneFile    string   `yaml:"zoneFile,omitempty"` // master file with more static records, reloaded on SIGHUP
+	DNSSEC      DNSSEC   `yaml:"dnssec,omitempty"`
+}
+
+// DNSSEC enables online signing of a zone. KSK and ZSK are BIND style key files without
+// the .key/.private extension, as written by "server dnssec keygen". Without a ZSK the KSK signs everything.
+type DNSSEC struct {
+	KSK      string   `yaml:"ksk,omitempty"`
+	ZSK      string   `yaml:"zsk,omitempty"`
+	Validity Duration `yaml:"validity,omitempty"` // lifetime of the signatures
+}
+
+func (d DNSSEC) Enabled() bool {
+	return d.KSK != ""
+}
+
+type TTLConfig struct {
+	Room         uint32 `yaml:"room"`         // TTL of room TXT answers in seconds
+	Node         uint32 `yaml:"node"`         // TTL of node TXT answers in seconds
+	Static       uint32 `yaml:"static"`       // TTL of SOA, NS, A and AAAA answers in seconds
+	Negative     uint32 `yaml:"negative"`     // TTL of NXDOMAIN and NODATA answers in seconds
+	Registration int    `yaml:"registration"` // lifetime of a registered address in seconds
+}
+
+type EDNSConfig struct {
+	UDPSize        uint16   `yaml:"udpSize"`        // advertised UDP buffer size, 1232 avoids IP fragmentation
+	CookieRotation Duration `yaml:"cookieRotation"` // interval in which the server cookie secret is replaced
+
+	// answer TXT, SRV and PTR over UDP only to clients with a valid server cookie, the others are moved to TCP
+	// this limits the amplification of spoofed queries for large rooms
+	UDPListsNeedCookie bool `yaml:"udpListsNeedCookie"`
+}
+
+// TransferConfig allows secondary nameservers to copy the zones with AXFR/IXFR.
+// Transfers are disabled without allowFrom and tsigKeys, with both a secondary needs the address and a signature.
+type TransferConfig struct {
+	AllowFrom   []string  `yaml:"allowFrom"`   // CIDRs that may transfer the zones, e.g. "192.0.2.0/24"
+	TSIGKeys    []TSIGKey `yaml:"tsigKeys"`    // transfers need a signature of one of the keys if set
+	Secondaries []string  `yaml:"secondaries"` // host:port of secondaries that get a NOTIFY when the zones change
+	NotifyKey   string    `yaml:"notifyKey"`   // name of the TSIG key that signs NOTIFY messages, unsigned if empty
+	JournalSize int       `yaml:"journalSize"` // number of changes kept for IXFR
+}
+
+type TSIGKey struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm"` // e.g. hmac-sha256
+	Secret    string `yaml:"secret"`    // base64, e.g. from "tsig-keygen"
+}
+
+type RateLimitConfig struct {
+	UDP       Limit `yaml:"udp"`
+	GlobalUDP Limit `yaml:"globalUdp"`
+	TCP       Limit `yaml:"tcp"`
+	Register  Limit `yaml:"register"` // registrations and deregistrations per client IP
+}
+
+type Limit struct {
+	Tokens   uint64   `yaml:"tokens"`
+	Interval Duration `yaml:"interval"`
+}
+
+type RegisterConfig struct {
+	AllowV1        bool     `yaml:"allowV1"`        // accept the legacy format that only signs the room name
+	MaxClockSkew   Duration `yaml:"maxClockSkew"`   // allowed difference between v2 timestamps and server time
+	NonceCacheSize int      `yaml:"nonceCacheSize"` // max number of remembered v2 nonces
+}
+
+type CacheConfig struct {
+	Backend string `yaml:"backend"` // freecache (in memory), bolt (file on disk) or memory (simple map)
+	SizeMB  int    `yaml:"sizeMB"`  // size of the freecache backend
+	Path    string `yaml:"path"`    // database file of the bolt backend
+}
+
+// SnapshotConfig saves all rooms and nodes to a file every interval and on shutdown, they are restored on start.
+type SnapshotConfig struct {
+	Path     string   `yaml:"path"` // disabled if empty
+	Interval Duration `yaml:"interval"`
+}
+
+// ReplicationConfig shares the rooms and nodes with other instances, so all nameservers of a zone answer the same.
+// Changes are pushed to the peers right away and the whole state of every peer is merged every interval.
+type ReplicationConfig struct {
+	Peers    []string `yaml:"peers"`    // base URLs of the HTTP servers of the other instances, disabled if empty
+	Secret   string   `yaml:"secret"`   // base64 secret shared by all instances, at least 32 bytes
+	Interval Duration `yaml:"interval"` // interval of the full state pulls
+}
+
+// FederationConfig exchanges signed registrations with beacons of other operators. Only registrations with
+// a node and a signed expiry are exchanged, every beacon verifies them with the room key before storing them.
+type FederationConfig struct {
+	Peers       []FederationPeer `yaml:"peers"`       // trusted beacons, disabled if empty
+	Interval    Duration         `yaml:"interval"`    // interval of the full record pulls
+	MaxLifetime Duration         `yaml:"maxLifetime"` // longest accepted time between timestamp and expiry of a record
+	RateLimit   Limit            `yaml:"rateLimit"`   // records per peer
+}
+
+// FederationPeer is a trusted beacon, requests between both beacons are signed with the secret.
+type FederationPeer struct {
+	URL    string `yaml:"url"`    // base URL of the HTTP server of the peer
+	Secret string `yaml:"secret"` // base64 secret shared with this peer only, at least 32 bytes
+}
+
+type LogConfig struct {
+	Path  string `yaml:"path"` // file path, "stdout" or "stderr"
+	Level string `yaml:"level"`
+}
+
+// Duration is a time.Duration that is written as "1m30s" in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("Invalid duration %q: %v", value.Value, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func Default() *Config {
+	cfg := &Config{
+		Listen: ListenConfig{
+			HTTP: ":8088",
+			DNS:  ":8053",
+		},
+		Zones: []ZoneConfig{
+			{Apex: "pathfinderbeacon.net."},
+			{Apex: "heidenstedt.org."},
+		},
+		TTL: TTLConfig{
+			Room:         300,
+			Node:         3600,
+			Static:       300,
+			Negative:     60,
+			Registration: 3600,
+		},
+		EDNS: EDNSConfig{
+			UDPSize:            1232,
+			CookieRotation:     Duration(time.Hour),
+			UDPListsNeedCookie: true,
+		},
+		Transfer: TransferConfig{
+			JournalSize: 100,
+		},
+		RateLimit: RateLimitConfig{
+			UDP:       Limit{Tokens: 20, Interval: Duration(time.Minute)},
+			GlobalUDP: Limit{Tokens: 300, Interval: Duration(time.Minute)},
+			TCP:       Limit{Tokens: 500, Interval: Duration(5 * time.Minute)},
+			Register:  Limit{Tokens: 60, Interval: Duration(time.Minute)},
+		},
+		Cache: CacheConfig{
+			Backend: cache.BackendFreecache,
+			SizeMB:  1000,
+			Path:    "/data/beacon.db",
+		},
+		Snapshot: SnapshotConfig{
+			Interval: Duration(5 * time.Minute),
+		},
+		Replication: ReplicationConfig{
+			Interval: Duration(30 * time.Second),
+		},
+		Federation: FederationConfig{
+			Interval:    Duration(5 * time.Minute),
+			MaxLifetime: Duration(24 * time.Hour),
+			RateLimit:   Limit{Tokens: 10000, Interval: Duration(time.Minute)},
+		},
+		Register: RegisterConfig{
+			AllowV1:        true,
+			MaxClockSkew:   Duration(5 * time.Minute),
+			NonceCacheSize: 100000,
+		},
+		Log: LogConfig{
+			Path:  "/logs/server.log",
+			Level: "info",
+		},
+		DemoRoom: "NoDemoRoomName",
+		Template: "template/index.tmpl",
+	}
+
+	if os.Getenv("PROD_MODE") == "true" {
+		cfg.Listen.HTTP = ":80"
+		cfg.Listen.DNS = ":53"
+	}
+
+	return cfg
+}
+
+// Load builds the effective configuration from defaults, the config file,
+// environment variables and command line flags, in this order of precedence.
+// It also reports whether --print-config was requested.
+func Load(args []string) (*Config, bool, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+
+	configPath := fs.String("config", os.Getenv("PATHFINDER_CONFIG"), "path to a YAML config file")
+	printConfig := fs.Bool("print-config", false, "print the effective config and exit")
+	httpAddr := fs.String("http-addr", "", "HTTP listen address")
+	dnsAddr := fs.String("dns-addr", "", "DNS listen address for UDP and TCP")
+	dotAddr := fs.String("dot-addr", "", "DNS over TLS listen address, e.g. :853")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file for DNS over TLS")
+	tlsKey := fs.String("tls-key", "", "TLS key file for DNS over TLS")
+	zones := fs.String("zones", "", "comma separated list of zone apexes")
+	cacheBackend := fs.String("cache-backend", "", "storage backend: freecache, bolt or memory")
+	cacheSize := fs.Int("cache-size-mb", 0, "cache size in MiB")
+	cachePath := fs.String("cache-path", "", "database file of the bolt backend")
+	snapshotPath := fs.String("snapshot-path", "", "file for snapshots of all rooms and nodes")
+	logPath := fs.String("log-path", "", "log file path, stdout or stderr")
+	logLevel := fs.String("log-level", "", "log level (debug, info, warn, error)")
+	demoRoom := fs.String("demo-room", "", "name of the demo room whose entries never expire")
+	tmpl := fs.String("template", "", "path of the landing page template")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	cfg := Default()
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, false, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "http-addr":
+			cfg.Listen.HTTP = *httpAddr
+		case "dns-addr":
+			cfg.Listen.DNS = *dnsAddr
+		case "dot-addr":
+			cfg.Listen.DoT = *dotAddr
+		case "tls-cert":
+			cfg.TLS.CertFile = *tlsCert
+		case "tls-key":
+			cfg.TLS.KeyFile = *tlsKey
+		case "zones":
+			cfg.Zones = zonesFromList(*zones)
+		case "cache-backend":
+			cfg.Cache.Backend = *cacheBackend
+		case "cache-size-mb":
+			cfg.Cache.SizeMB = *cacheSize
+		case "cache-path":
+			cfg.Cache.Path = *cachePath
+		case "snapshot-path":
+			cfg.Snapshot.Path = *snapshotPath
+		case "log-path":
+			cfg.Log.Path = *logPath
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "demo-room":
+			cfg.DemoRoom = *demoRoom
+		case "template":
+			cfg.Template = *tmpl
+		}
+	})
+
+	cfg.normalize()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, false, err
+	}
+
+	return cfg, *printConfig, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open config file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("Failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv() error {
+	if v := os.Getenv("PATHFINDER_HTTP_ADDR"); v != "" {
+		c.Listen.HTTP = v
+	}
+	if v := os.Getenv("PATHFINDER_DNS_ADDR"); v != "" {
+		c.Listen.DNS = v
+	}
+	if v := os.Getenv("PATHFINDER_DOT_ADDR"); v != "" {
+		c.Listen.DoT = v
+	}
+	if v := os.Getenv("PATHFINDER_TLS_CERT"); v != "" {
+		c.TLS.CertFile = v
+	}
+	if v := os.Getenv("PATHFINDER_TLS_KEY"); v != "" {
+		c.TLS.KeyFile = v
+	}
+	if v := firstEnv("PATHFINDER_ZONES", "ZONES"); v != "" {
+		c.Zones = zonesFromList(v)
+	}
+	if v := os.Getenv("PATHFINDER_CACHE_SIZE_MB"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("Invalid PATHFINDER_CACHE_SIZE_MB: %v", err)
+		}
+		c.Cache.SizeMB = size
+	}
+	if v := os.Getenv("PATHFINDER_CACHE_BACKEND"); v != "" {
+		c.Cache.Backend = v
+	}
+	if v := os.Getenv("PATHFINDER_CACHE_PATH"); v != "" {
+		c.Cache.Path = v
+	}
+	if v := os.Getenv("PATHFINDER_SNAPSHOT_PATH"); v != "" {
+		c.Snapshot.Path = v
+	}
+	if v := os.Getenv("PATHFINDER_REPLICATION_PEERS"); v != "" {
+		c.Replication.Peers = strings.Split(v, ",")
+	}
+	if v := os.Getenv("PATHFINDER_REPLICATION_SECRET"); v != "" {
+		c.Replication.Secret = v
+	}
+	if v := os.Getenv("PATHFINDER_LOG_PATH"); v != "" {
+		c.Log.Path = v
+	}
+	if v := os.Getenv("PATHFINDER_LOG_LEVEL"); v != "" {
+		c.Log.Level = v
+	}
+	if v := firstEnv("PATHFINDER_DEMO_ROOM", "DEMO_ROOM_NAME"); v != "" {
+		c.DemoRoom = v
+	}
+	if v := os.Getenv("PATHFINDER_ALLOW_V1_REGISTRATION"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid PATHFINDER_ALLOW_V1_REGISTRATION: %v", err)
+		}
+		c.Register.AllowV1 = allow
+	}
+	if v := os.Getenv("PATHFINDER_TEMPLATE"); v != "" {
+		c.Template = v
+	}
+	return nil
+}
+
+// normalize fills in the zone defaults so --print-config shows the effective values.
+func (c *Config) normalize() {
+	for i := range c.Zones {
+		z := &c.Zones[i]
+		if z.Apex != "" {
+			z.Apex = dns.Fqdn(strings.ToLower(z.Apex))
+		}
+		if len(z.Nameservers) == 0 {
+			z.Nameservers = []string{zone.DefaultNameserver}
+		}
+		if z.Hostmaster == "" {
+			z.Hostmaster = zone.DefaultHostmaster
+		}
+		if z.Records == nil && z.ZoneFile == "" {
+			z.Records = append([]string(nil), zone.DefaultRecords...)
+		}
+		if z.DNSSEC.Enabled() {
+			if z.DNSSEC.ZSK == "" {
+				z.DNSSEC.ZSK = z.DNSSEC.KSK
+			}
+			if z.DNSSEC.Validity == 0 {
+				z.DNSSEC.Validity = Duration(7 * 24 * time.Hour)
+			}
+		}
+	}
+
+	for i := range c.Transfer.TSIGKeys {
+		key := &c.Transfer.TSIGKeys[i]
+		key.Name = dns.Fqdn(strings.ToLower(key.Name))
+		if key.Algorithm == "" {
+			key.Algorithm = dns.HmacSHA256
+		}
+		key.Algorithm = dns.Fqdn(strings.ToLower(key.Algorithm))
+	}
+	if c.Transfer.NotifyKey != "" {
+		c.Transfer.NotifyKey = dns.Fqdn(strings.ToLower(c.Transfer.NotifyKey))
+	}
+}
+
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen.HTTP); err != nil {
+		return fmt.Errorf("Invalid listen.http %q: %v", c.Listen.HTTP, err)
+	}
+	if _, _, err := net.SplitHostPort(c.Listen.DNS); err != nil {
+		return fmt.Errorf("Invalid listen.dns %q: %v", c.Listen.DNS, err)
+	}
+
+	if c.Listen.DoT != "" {
+		if _, _, err := net.SplitHostPort(c.Listen.DoT); err != nil {
+			return fmt.Errorf("Invalid listen.dot %q: %v", c.Listen.DoT, err)
+		}
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			return fmt.Errorf("listen.dot needs tls.certFile and tls.keyFile")
+		}
+	}
+
+	if len(c.Zones) == 0 {
+		return fmt.Errorf("At least one zone is required")
+	}
+	for _, z := range c.Zones {
+		if z.Apex == "" {
+			return fmt.Errorf("Zone apex is empty")
+		}
+		if z.DNSSEC.ZSK != "" && !z.DNSSEC.Enabled() {
+			return fmt.Errorf("Zone %s: dnssec.zsk needs a dnssec.ksk", z.Apex)
+		}
+		if z.DNSSEC.Enabled() && z.DNSSEC.Validity < Duration(6*time.Hour) {
+			return fmt.Errorf("Zone %s: dnssec.validity must be at least 6h", z.Apex)
+		}
+	}
+
+	if c.TTL.Room == 0 || c.TTL.Node == 0 || c.TTL.Static == 0 || c.TTL.Negative == 0 {
+		return fmt.Errorf("DNS TTLs must be greater than 0")
+	}
+	if c.TTL.Registration <= 0 {
+		return fmt.Errorf("ttl.registration must be greater than 0")
+	}
+
+	if c.EDNS.UDPSize < 512 {
+		return fmt.Errorf("edns.udpSize must be at least 512")
+	}
+	if c.EDNS.CookieRotation <= 0 {
+		return fmt.Errorf("edns.cookieRotation must be greater than 0")
+	}
+
+	if err := c.Transfer.validate(); err != nil {
+		return err
+	}
+	for _, z := range c.Zones {
+		// transfers do not contain the DNSKEY, RRSIG and NSEC records, secondaries would serve a bogus zone
+		if c.Transfer.Enabled() && z.DNSSEC.Enabled() {
+			return fmt.Errorf("Zone %s: transfer can not be used with dnssec, transfers are not signed", z.Apex)
+		}
+	}
+
+	for name, l := range map[string]Limit{"udp": c.RateLimit.UDP, "globalUdp": c.RateLimit.GlobalUDP, "tcp": c.RateLimit.TCP, "register": c.RateLimit.Register} {
+		if l.Tokens == 0 || l.Interval <= 0 {
+			return fmt.Errorf("rateLimit.%s needs tokens and an interval greater than 0", name)
+		}
+	}
+
+	if c.Register.MaxClockSkew <= 0 {
+		return fmt.Errorf("registration.maxClockSkew must be greater than 0")
+	}
+	if c.Register.NonceCacheSize <= 0 {
+		return fmt.Errorf("registration.nonceCacheSize must be greater than 0")
+	}
+
+	switch c.Cache.Backend {
+	case cache.BackendFreecache:
+		if c.Cache.SizeMB <= 0 {
+			return fmt.Errorf("cache.sizeMB must be greater than 0")
+		}
+	case cache.BackendBolt:
+		if c.Cache.Path == "" {
+			return fmt.Errorf("cache.path is empty")
+		}
+	case cache.BackendMemory:
+	default:
+		return fmt.Errorf("Invalid cache.backend %q", c.Cache.Backend)
+	}
+
+	if c.Snapshot.Path != "" && c.Snapshot.Interval <= 0 {
+		return fmt.Errorf("snapshot.interval must be greater than 0")
+	}
+
+	if err := c.Replication.validate(); err != nil {
+		return err
+	}
+	if err := c.Federation.validate(); err != nil {
+		return err
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("Invalid log.level %q", c.Log.Level)
+	}
+	if c.Log.Path == "" {
+		return fmt.Errorf("log.path is empty")
+	}
+
+	if c.Template == "" {
+		return fmt.Errorf("template is empty")
+	}
+
+	return nil
+}
+
+// Enabled reports whether secondaries may transfer the zones.
+func (t TransferConfig) Enabled() bool {
+	return len(t.AllowFrom) > 0 || len(t.TSIGKeys) > 0
+}
+
+func (t TransferConfig) validate() error {
+	for _, cidr := range t.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("Invalid transfer.allowFrom %q: %v", cidr, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, key := range t.TSIGKeys {
+		switch key.Algorithm {
+		case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return fmt.Errorf("TSIG key %s: unsupported algorithm %q", key.Name, key.Algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil || key.Secret == "" {
+			return fmt.Errorf("TSIG key %s: secret must be base64", key.Name)
+		}
+		names[key.Name] = true
+	}
+	if t.NotifyKey != "" && !names[t.NotifyKey] {
+		return fmt.Errorf("transfer.notifyKey %s is not in transfer.tsigKeys", t.NotifyKey)
+	}
+
+	for _, secondary := range t.Secondaries {
+		if _, _, err := net.SplitHostPort(secondary); err != nil {
+			return fmt.Errorf("Invalid transfer.secondaries %q: %v", secondary, err)
+		}
+	}
+
+	if t.JournalSize <= 0 {
+		return fmt.Errorf("transfer.journalSize must be greater than 0")
+	}
+	return nil
+}
+
+func (r ReplicationConfig) validate() error {
+	if len(r.Peers) == 0 {
+		return nil
+	}
+
+	for _, peer := range r.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid replication.peers %q: must be a http or https URL", peer)
+		}
+	}
+	secret, err := base64.StdEncoding.DecodeString(r.Secret)
+	if err != nil || len(secret) < 32 {
+		return fmt.Errorf("replication.secret must be base64 with at least 32 bytes")
+	}
+	if r.Interval <= 0 {
+		return fmt.Errorf("replication.interval must be greater than 0")
+	}
+	return nil
+}
+
+func (f FederationConfig) validate() error {
+	if len(f.Peers) == 0 {
+		return nil
+	}
+
+	secrets := make(map[string]bool)
+	for _, peer := range f.Peers {
+		u, err := url.Parse(peer.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid federation.peers url %q: must be a http or https URL", peer.URL)
+		}
+		secret, err := base64.StdEncoding.DecodeString(peer.Secret)
+		if err != nil || len(secret) < 32 {
+			return fmt.Errorf("Invalid federation.peers secret of %q: must be base64 with at least 32 bytes", peer.URL)
+		}
+		// the secret identifies the peer of a request
+		if secrets[string(secret)] {
+			return fmt.Errorf("Invalid federation.peers secret of %q: every peer needs its own secret", peer.URL)
+		}
+		secrets[string(secret)] = true
+	}
+	if f.Interval <= 0 || f.MaxLifetime <= 0 {
+		return fmt.Errorf("federation.interval and federation.maxLifetime must be greater than 0")
+	}
+	if f.RateLimit.Tokens == 0 || f.RateLimit.Interval <= 0 {
+		return fmt.Errorf("federation.rateLimit needs tokens and an interval greater than 0")
+	}
+	return nil
+}
+
+// Print writes the config as YAML, secrets are replaced by redacted.
+func (c *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(c.redacted())
+}
+
+const redacted = "***"
+
+// redacted returns a copy of c without the secrets, empty secrets stay empty.
+func (c *Config) redacted() *Config {
+	redact := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return redacted
+	}
+
+	r := *c
+	r.Transfer.TSIGKeys = make([]TSIGKey, len(c.Transfer.TSIGKeys))
+	for i, key := range c.Transfer.TSIGKeys {
+		key.Secret = redact(key.Secret)
+		r.Transfer.TSIGKeys[i] = key
+	}
+	r.Replication.Secret = redact(c.Replication.Secret)
+	r.Federation.Peers = make([]FederationPeer, len(c.Federation.Peers))
+	for i, peer := range c.Federation.Peers {
+		peer.Secret = redact(peer.Secret)
+		r.Federation.Peers[i] = peer
+	}
+	return &r
+}
+
+func zonesFromList(list string) []ZoneConfig {
+	var zones []ZoneConfig
+	for _, apex := range strings.Split(list, ",") {
+		apex = strings.TrimSpace(apex)
+		if apex != "" {
+			zones = append(zones, ZoneConfig{Apex: apex})
+		}
+	}
+	return zones
+}
+
+func firstEnv(keys ...string) string {
+	for _, key := range keys {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
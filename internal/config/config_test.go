@@ -0,0 +1,104 @@
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		secret string // must not be printed, empty if nothing is set
+	}{
+		{
+			name:   "tsig key",
+			config: Config{Transfer: TransferConfig{TSIGKeys: []TSIGKey{{Name: "xfr.", Algorithm: "hmac-sha256", Secret: "tsig-secret"}}}},
+			secret: "tsig-secret",
+		},
+		{
+			name:   "replication secret",
+			config: Config{Replication: ReplicationConfig{Secret: "replication-secret"}},
+			secret: "replication-secret",
+		},
+		{
+			name:   "federation peer secret",
+			config: Config{Federation: FederationConfig{Peers: []FederationPeer{{URL: "https://peer.example.org", Secret: "peer-secret"}}}},
+			secret: "peer-secret",
+		},
+		{
+			name:   "empty secrets stay empty",
+			config: Config{Federation: FederationConfig{Peers: []FederationPeer{{URL: "https://peer.example.org"}}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := tt.config.Print(&out); err != nil {
+				t.Fatal(err)
+			}
+
+			printed := out.String()
+			if tt.secret == "" {
+				if strings.Contains(printed, redacted) {
+					t.Errorf("empty secret printed as %q:\n%s", redacted, printed)
+				}
+				return
+			}
+			if strings.Contains(printed, tt.secret) {
+				t.Errorf("secret printed:\n%s", printed)
+			}
+			if !strings.Contains(printed, "secret: '"+redacted+"'") {
+				t.Errorf("secret not replaced by %q:\n%s", redacted, printed)
+			}
+		})
+	}
+
+	// the config itself keeps its secrets
+	c := Config{Replication: ReplicationConfig{Secret: "replication-secret"}}
+	c.Print(&bytes.Buffer{})
+	if c.Replication.Secret != "replication-secret" {
+		t.Errorf("Print changed the secret of the config to %q", c.Replication.Secret)
+	}
+}
+
+func TestValidateTransferWithDNSSEC(t *testing.T) {
+	tests := []struct {
+		name     string
+		transfer TransferConfig
+		dnssec   DNSSEC
+		wantErr  bool
+	}{
+		{name: "transfer without dnssec", transfer: TransferConfig{AllowFrom: []string{"192.0.2.0/24"}}},
+		{name: "dnssec without transfer", dnssec: DNSSEC{KSK: "Kexample.org.+013+12345", Validity: Duration(7 * 24 * time.Hour)}},
+		{
+			name:     "transfer by address with dnssec",
+			transfer: TransferConfig{AllowFrom: []string{"192.0.2.0/24"}},
+			dnssec:   DNSSEC{KSK: "Kexample.org.+013+12345", Validity: Duration(7 * 24 * time.Hour)},
+			wantErr:  true,
+		},
+		{
+			name:     "transfer by key with dnssec",
+			transfer: TransferConfig{TSIGKeys: []TSIGKey{{Name: "xfr.", Algorithm: "hmac-sha256", Secret: "c2VjcmV0"}}},
+			dnssec:   DNSSEC{KSK: "Kexample.org.+013+12345", Validity: Duration(7 * 24 * time.Hour)},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			c.Transfer.AllowFrom = tt.transfer.AllowFrom
+			c.Transfer.TSIGKeys = tt.transfer.TSIGKeys
+			c.Zones[0].DNSSEC = tt.dnssec
+
+			err := c.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
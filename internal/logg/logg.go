@@ -4,25 +4,34 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"go.uber.org/zap"
 )
 
-func InitLogger() *zap.Logger {
+// InitLogger creates a production logger writing to path, which can also be "stdout" or "stderr".
+func InitLogger(path string, level string) *zap.Logger {
 
-	absPath := "/logs/server.log"
-	err := os.MkdirAll("/logs", 0755)
-	if err != nil {
-		fmt.Printf("Failed to create logs folder: %v \n", err)
-		return nil
+	if path != "stdout" && path != "stderr" {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			fmt.Printf("Failed to create logs folder: %v \n", err)
+			return nil
+		}
 	}
 
 	cfg := zap.NewProductionConfig()
 
-	fmt.Println(absPath)
+	atomicLevel, err := zap.ParseAtomicLevel(level)
+	if err != nil {
+		log.Fatalf("Failed to parse log level: %s\n", err)
+	}
+	cfg.Level = atomicLevel
+
+	fmt.Println(path)
 
 	cfg.OutputPaths = []string{
-		absPath,
+		path,
 	}
 	logger, err := cfg.Build()
 	if err != nil {
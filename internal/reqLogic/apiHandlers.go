@@ -0,0 +1,134 @@
+package reqLogic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"go.uber.org/zap"
+)
+
+type apiAddress struct {
+	Protocol string `json:"protocol"`
+	Ip       string `json:"ip"`
+	Port     int    `json:"port"`
+	TTL      uint32 `json:"ttl"` // remaining seconds, 0 means it never expires
+}
+
+type apiNode struct {
+	Node      string       `json:"node"`
+	TTL       uint32       `json:"ttl"` // remaining seconds of the room membership, 0 means it never expires
+	Addresses []apiAddress `json:"addresses"`
+}
+
+type apiRoom struct {
+	Room  string    `json:"room"`
+	Nodes []apiNode `json:"nodes"`
+}
+
+// RoomLookupHandler serves GET /v1/rooms/{room} with the nodes of the room and their addresses.
+func (d *ReqLogic) RoomLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if !d.rateLimitHTTP(w, r) {
+		return
+	}
+
+	room := r.PathValue("room")
+	if !utils.CheckIfSha224(room) {
+		writeJSONError(w, "room is not a valid sha224 hash", http.StatusBadRequest)
+		return
+	}
+
+	members := d.getRoomNodes(room)
+	if len(members) == 0 {
+		writeJSONError(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	result := apiRoom{Room: room, Nodes: make([]apiNode, 0, len(members))}
+	for _, member := range members {
+		node := d.lookupNode(member.Value, now)
+		node.TTL = member.Remaining(now)
+		result.Nodes = append(result.Nodes, node)
+	}
+
+	d.writeJSON(w, result)
+}
+
+// NodeLookupHandler serves GET /v1/nodes/{node} with the addresses of the node.
+func (d *ReqLogic) NodeLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if !d.rateLimitHTTP(w, r) {
+		return
+	}
+
+	nodeName := r.PathValue("node")
+	if !utils.CheckIfSha224(nodeName) {
+		writeJSONError(w, "node is not a valid sha224 hash", http.StatusBadRequest)
+		return
+	}
+
+	node := d.lookupNode(nodeName, time.Now())
+	if len(node.Addresses) == 0 {
+		writeJSONError(w, "node not found", http.StatusNotFound)
+		return
+	}
+
+	d.writeJSON(w, node)
+}
+
+func (d *ReqLogic) lookupNode(nodeName string, now time.Time) apiNode {
+	addresses := d.getNodeAddresses(nodeName)
+
+	node := apiNode{Node: nodeName, Addresses: make([]apiAddress, 0, len(addresses))}
+	for _, addr := range addresses {
+		node.Addresses = append(node.Addresses, apiAddress{
+			Protocol: addr.Address.Protocol,
+			Ip:       addr.Address.Ip,
+			Port:     addr.Address.Port,
+			TTL:      addr.Entry.Remaining(now),
+		})
+	}
+	return node
+}
+
+// rateLimitHTTP takes a token of the TCP rate limit store for the client and answers 429 if none is left.
+func (d *ReqLogic) rateLimitHTTP(w http.ResponseWriter, r *http.Request) bool {
+	host, err := getClientHost(r)
+	if err != nil {
+		writeJSONError(w, "Failed to get client host", http.StatusInternalServerError)
+		return false
+	}
+
+	_, _, reset, ok, err := d.rateLimitStoreTCP.Take(context.Background(), host)
+	if err != nil {
+		d.logger.Error("Failed to get rate limit HTTP", zap.String("host", host), zap.Error(err))
+		writeJSONError(w, "Failed to get rate limit", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(time.Until(time.Unix(0, int64(reset))).Seconds())+1))
+		writeJSONError(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+func (d *ReqLogic) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		d.logger.Warn("Failed to write JSON", zap.Error(err))
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
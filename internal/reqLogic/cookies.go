@@ -0,0 +1,117 @@
+package reqLogic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16 // RFC 9018 layout: version, reserved, timestamp and hash
+
+	cookieVersion = 1
+	cookieMaxAge  = time.Hour       // older server cookies are no longer accepted (RFC 9018 4.3)
+	cookieMaxSkew = 5 * time.Minute // allowed timestamps from the future
+	cookieRenew   = 30 * time.Minute
+)
+
+// cookieSecrets creates and checks DNS server cookies (RFC 7873, RFC 9018).
+// The hash is a HMAC-SHA256 over the client cookie, the header of the server cookie and the client IP,
+// truncated to 8 bytes. The secret is rotated every interval, cookies of the previous secret stay valid.
+type cookieSecrets struct {
+	mu       sync.Mutex
+	current  []byte
+	previous []byte
+	rotated  time.Time
+	interval time.Duration
+}
+
+func newCookieSecrets(interval time.Duration) *cookieSecrets {
+	c := &cookieSecrets{interval: interval}
+	c.rotate(time.Now())
+	return c
+}
+
+func (c *cookieSecrets) rotate(now time.Time) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		// keep the old secret, cookies are still valid, only not rotated
+		return
+	}
+	c.previous = c.current
+	c.current = secret
+	c.rotated = now
+}
+
+func (c *cookieSecrets) secrets(now time.Time) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.rotated) >= c.interval {
+		c.rotate(now)
+	}
+	if c.previous == nil {
+		return [][]byte{c.current}
+	}
+	return [][]byte{c.current, c.previous}
+}
+
+// serverCookie returns a new server cookie for the client cookie and IP.
+func (c *cookieSecrets) serverCookie(clientCookie []byte, ip net.IP, now time.Time) []byte {
+	cookie := make([]byte, 8, serverCookieLen)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+
+	return append(cookie, cookieHash(c.secrets(now)[0], clientCookie, cookie[:8], ip)...)
+}
+
+// valid reports whether serverCookie was created by this server for the client cookie and IP,
+// and if it should be replaced by a new one.
+func (c *cookieSecrets) valid(clientCookie []byte, serverCookie []byte, ip net.IP, now time.Time) (bool, bool) {
+	if len(serverCookie) != serverCookieLen || serverCookie[0] != cookieVersion {
+		return false, true
+	}
+
+	created := time.Unix(int64(binary.BigEndian.Uint32(serverCookie[4:8])), 0)
+	if now.Sub(created) > cookieMaxAge || created.Sub(now) > cookieMaxSkew {
+		return false, true
+	}
+
+	for _, secret := range c.secrets(now) {
+		if hmac.Equal(serverCookie[8:], cookieHash(secret, clientCookie, serverCookie[:8], ip)) {
+			return true, now.Sub(created) > cookieRenew
+		}
+	}
+	return false, true
+}
+
+func cookieHash(secret []byte, clientCookie []byte, header []byte, ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(clientCookie)
+	mac.Write(header)
+	mac.Write(ip)
+	return mac.Sum(nil)[:8]
+}
+
+// parseCookie splits the hex encoded option of a request into the client and server cookie.
+// It reports false for malformed options, which are answered with FORMERR.
+func parseCookie(option string) ([]byte, []byte, bool) {
+	cookie, err := hex.DecodeString(option)
+	if err != nil {
+		return nil, nil, false
+	}
+	if len(cookie) != clientCookieLen && (len(cookie) < clientCookieLen+8 || len(cookie) > clientCookieLen+32) {
+		return nil, nil, false
+	}
+	return cookie[:clientCookieLen], cookie[clientCookieLen:], true
+}
@@ -0,0 +1,113 @@
+package reqLogic
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCookieValid(t *testing.T) {
+	clientCookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ip := net.ParseIP("192.0.2.1")
+
+	tests := []struct {
+		name         string
+		age          time.Duration   // of the server cookie when it is checked
+		rotations    []time.Duration // secrets are read at these ages before the check
+		clientCookie []byte          // sent with the server cookie, the issued one if nil
+		ip           string          // of the client, the issued one if empty
+		edit         func(cookie []byte)
+		wantValid    bool
+		wantRenew    bool
+	}{
+		{name: "fresh cookie", age: time.Minute, wantValid: true},
+		{name: "cookie to renew", age: 45 * time.Minute, wantValid: true, wantRenew: true},
+		{name: "expired cookie", age: 2 * time.Hour, wantRenew: true},
+		{name: "cookie from the future", age: -10 * time.Minute, wantRenew: true},
+		{name: "other client cookie", age: time.Minute, clientCookie: []byte{8, 7, 6, 5, 4, 3, 2, 1}, wantRenew: true},
+		{name: "other client ip", age: time.Minute, ip: "192.0.2.2", wantRenew: true},
+		{name: "changed timestamp", age: time.Minute, edit: func(cookie []byte) { cookie[7]++ }, wantRenew: true},
+		{name: "unknown version", age: time.Minute, edit: func(cookie []byte) { cookie[0] = 2 }, wantRenew: true},
+		{name: "previous secret", age: 15 * time.Minute, wantValid: true},
+		{
+			name:      "secret rotated twice",
+			age:       25 * time.Minute,
+			rotations: []time.Duration{15 * time.Minute},
+			wantRenew: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued := time.Now()
+			c := newCookieSecrets(10 * time.Minute)
+			cookie := c.serverCookie(clientCookie, ip, issued)
+			if tt.edit != nil {
+				tt.edit(cookie)
+			}
+
+			for _, rotation := range tt.rotations {
+				c.secrets(issued.Add(rotation))
+			}
+
+			sentClientCookie := clientCookie
+			if tt.clientCookie != nil {
+				sentClientCookie = tt.clientCookie
+			}
+			sentIP := ip
+			if tt.ip != "" {
+				sentIP = net.ParseIP(tt.ip)
+			}
+
+			valid, renew := c.valid(sentClientCookie, cookie, sentIP, issued.Add(tt.age))
+			if valid != tt.wantValid || renew != tt.wantRenew {
+				t.Errorf("valid = %v, renew = %v, want %v and %v", valid, renew, tt.wantValid, tt.wantRenew)
+			}
+		})
+	}
+}
+
+func TestParseCookie(t *testing.T) {
+	tests := []struct {
+		name       string
+		option     string
+		wantClient []byte
+		wantServer []byte
+		wantOK     bool
+	}{
+		{
+			name:       "client cookie only",
+			option:     "0102030405060708",
+			wantClient: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			wantServer: []byte{},
+			wantOK:     true,
+		},
+		{
+			name:       "client and server cookie",
+			option:     "0102030405060708" + "1112131415161718191a1b1c1d1e1f20",
+			wantClient: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			wantServer: []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20},
+			wantOK:     true,
+		},
+		{name: "short client cookie", option: "01020304"},
+		{name: "short server cookie", option: "0102030405060708" + "11121314"},
+		{name: "long server cookie", option: "0102030405060708" + "11121314151617181112131415161718111213141516171811121314151617181112"},
+		{name: "not hex", option: "010203040506070x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server, ok := parseCookie(tt.option)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !bytes.Equal(client, tt.wantClient) || !bytes.Equal(server, tt.wantServer) {
+				t.Errorf("cookies = %x %x, want %x %x", client, server, tt.wantClient, tt.wantServer)
+			}
+		})
+	}
+}
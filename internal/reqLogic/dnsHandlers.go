@@ -2,74 +2,112 @@ package reqLogic
 
 import (
 	"context"
-	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
 	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
 
-func generateCookie() string {
-	cookie := make([]byte, 64)
-	_, err := rand.Read(cookie)
-	if err != nil {
-		log.Fatalf("Failed to generate cookie: %s\n", err)
+// setEdns0AndCookieAndCreateMsg creates the reply to r. If r has an OPT record the reply gets one
+// with the UDP buffer size of the server, the DO bit of the request and a server cookie.
+// It reports whether r carried a valid server cookie, and false if r has to be answered
+// right away with the error set in msg.
+func (d *ReqLogic) setEdns0AndCookieAndCreateMsg(w dns.ResponseWriter, r *dns.Msg) (*dns.Msg, bool, bool) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+
+	opt := r.IsEdns0()
+	if opt == nil {
+		return msg, false, true
 	}
 
-	// return hex.EncodeToString(cookie)
-	return "0a57a6d8fa081b89"
-}
+	msg.SetEdns0(d.settings.UDPSize, opt.Do())
+	if opt.Version() != 0 {
+		msg.Rcode = dns.RcodeBadVers
+		return msg, false, false
+	}
 
-func checkForEdnsCookie(r *dns.Msg) string {
-	if opt := r.IsEdns0(); opt != nil {
-		for _, o := range opt.Option {
-			if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
-				return cookie.Cookie
-			}
+	validCookie := false
+	for _, option := range opt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
 		}
-	}
-	return ""
-}
 
-func setEdns0AndCookieAndCreateMsg(w dns.ResponseWriter, r *dns.Msg) *dns.Msg {
-	msg := new(dns.Msg)
-	msg.SetReply(r)
-	msg.Authoritative = true
+		clientCookie, serverCookie, ok := parseCookie(cookie.Cookie)
+		if !ok {
+			msg.Rcode = dns.RcodeFormatError
+			return msg, false, false
+		}
 
-	// optRecord := &dns.OPT{
-	// 	Hdr: dns.RR_Header{
-	// 		Name:   ".",
-	// 		Rrtype: dns.TypeOPT,
-	// 	},
-	// 	Option: []dns.EDNS0{
-	// 		&dns.EDNS0_COOKIE{
-	// 			Code:   dns.EDNS0COOKIE,
-	// 			Cookie: checkForEdnsCookie(r) + generateCookie(),
-	// 		},
-	// 	},
-	// }
-	// optRecord.SetUDPSize(4096)
-	// optRecord.SetDo()
-	// msg.Extra = append(msg.Extra, optRecord)
-	return msg
+		ip := net.ParseIP(getIPFromRemoteAddr(w.RemoteAddr().String()))
+		now := time.Now()
+		renew := true
+		if len(serverCookie) > 0 {
+			validCookie, renew = d.cookies.valid(clientCookie, serverCookie, ip, now)
+		}
+		if renew {
+			serverCookie = d.cookies.serverCookie(clientCookie, ip, now)
+		}
+
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(clientCookie) + hex.EncodeToString(serverCookie),
+		})
+		break
+	}
+
+	return msg, validCookie, true
 }
 
+// moveToTCP answers with an empty truncated response, so the client retries over TCP.
 func moveToTCP(msg *dns.Msg, w dns.ResponseWriter, r *dns.Msg) {
 	msg.SetRcode(r, dns.RcodeSuccess)
 	msg.Truncated = true
+	msg.Answer, msg.Ns = nil, nil
+	if opt := msg.IsEdns0(); opt != nil {
+		msg.Extra = []dns.RR{opt}
+	} else {
+		msg.Extra = nil
+	}
 	w.WriteMsg(msg)
 }
 
+// udpSize returns the largest UDP response the client accepts, 512 bytes without EDNS0.
+func (d *ReqLogic) udpSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil {
+		return int(min(max(opt.UDPSize(), dns.MinMsgSize), d.settings.UDPSize))
+	}
+	return dns.MinMsgSize
+}
+
+// needsTCP reports whether a UDP query for a list of a room or node has to be moved to TCP without a valid cookie.
+func (d *ReqLogic) needsTCP(w dns.ResponseWriter, validCookie bool) bool {
+	return IsUDPRequest(w.RemoteAddr()) && d.settings.UDPListsNeedCookie && !validCookie
+}
+
 func (d *ReqLogic) DNSReq(w dns.ResponseWriter, r *dns.Msg) {
 	start := time.Now()
 	ctx := context.Background()
 
+	msg, validCookie, ok := d.setEdns0AndCookieAndCreateMsg(w, r)
+	if !ok {
+		w.WriteMsg(msg)
+		return
+	}
+
 	var err error
+	// every UDP request counts against the global limit, a cookie only relaxes the per query limit
 	if IsUDPRequest(w.RemoteAddr()) {
 		_, _, _, ok, err := d.globalRateLimitStoreUDP.Take(ctx, getIPFromRemoteAddr(w.RemoteAddr().String()))
 		if err != nil {
@@ -81,25 +119,21 @@ func (d *ReqLogic) DNSReq(w dns.ResponseWriter, r *dns.Msg) {
 		}
 	}
 
-	var msg *dns.Msg
-
-	if IsUDPRequest(w.RemoteAddr()) {
-		msg = setEdns0AndCookieAndCreateMsg(w, r)
-	} else {
-		msg = new(dns.Msg)
-		msg.SetReply(r)
-		msg.Authoritative = true
-	}
-
 	defer func(start time.Time) {
 		ctxClose := context.Background()
-		tokens, remaining, errR := d.rateLimitStoreUDP.Get(ctxClose, getIPFromRemoteAddr(w.RemoteAddr().String()))
+		// log the limit the request was counted against, see rateLimit
+		store := d.rateLimitStoreTCP
+		if IsUDPRequest(w.RemoteAddr()) && !validCookie {
+			store = d.rateLimitStoreUDP
+		}
+		tokens, remaining, errR := store.Get(ctxClose, getIPFromRemoteAddr(w.RemoteAddr().String()))
 		if errR != nil {
 			fmt.Printf("Failed to get rate limit: %s\n", errR)
 		}
 		d.logger.Info("Request",
 			zap.String("remote_addr", w.RemoteAddr().String()),
 			zap.Bool("UDP", IsUDPRequest(w.RemoteAddr())),
+			zap.Bool("cookie", validCookie),
 			zap.Duration("duration", time.Since(start)),
 			zap.Uint64("rate_limit_tokens", tokens),
 			zap.Uint64("rate_limit_remaining", remaining),
@@ -108,42 +142,55 @@ func (d *ReqLogic) DNSReq(w dns.ResponseWriter, r *dns.Msg) {
 	}(start)
 
 	for _, q := range r.Question {
-		err = rateLimit(ctx, w, d)
+		err = rateLimit(ctx, w, d, validCookie)
 		if err != nil {
 			return
 		}
-		if utils.ToLowerCase(q.Name) != "pathfinderbeacon.net." && !strings.HasSuffix(utils.ToLowerCase(q.Name), ".pathfinderbeacon.net.") && !strings.HasSuffix(utils.ToLowerCase(q.Name), ".heidenstedt.org.") {
+		z := d.settings.Zones.Match(q.Name)
+		if z == nil {
 			msg.Rcode = dns.RcodeNameError
 			break
 		}
 
 		if !strings.HasSuffix("a."+utils.ToLowerCase(q.Name), ".q.") {
-			err = rateLimit(ctx, w, d)
+			err = rateLimit(ctx, w, d, validCookie)
 			if err != nil {
 				return
 			}
 		}
 
+		if r.Opcode == dns.OpcodeUpdate {
+			d.handleUpdate(w, r, msg, z)
+			return
+		}
+
+		if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+			d.handleTransfer(w, r, q, z)
+			return
+		}
+
 		switch q.Qtype {
-		case dns.TypeSOA:
-			handleSOARequest(msg, q)
-		case dns.TypeTXT:
-			// If the request is a UDP request, move it to TCP if it is a TXT request
-			if IsUDPRequest(w.RemoteAddr()) {
+		case dns.TypeTXT, dns.TypeSRV, dns.TypePTR:
+			if d.needsTCP(w, validCookie) {
 				moveToTCP(msg, w, r)
 				return
 			}
-			d.handleTXTRequest(msg, q)
-		case dns.TypeNS:
-			handleNSRequest(msg, q)
-		case dns.TypeA:
-			handleARequest(msg, q)
-		case dns.TypeAAAA:
-			handleAAAARequest(msg, q)
-		case dns.TypeCAA:
-		default:
-			handleNotImplemented(msg)
 		}
+
+		d.answerQuestion(msg, q, z)
+		d.negativeResponse(msg, q, z)
+	}
+
+	if len(r.Question) > 0 {
+		q := r.Question[0]
+		d.signResponse(msg, r, q, d.settings.Zones.Match(q.Name))
+	}
+
+	// TXT, SRV and PTR answers list whole rooms, they are only truncated if they do not fit
+	msg.Compress = true
+	if IsUDPRequest(w.RemoteAddr()) && msg.Len() > d.udpSize(r) {
+		moveToTCP(msg, w, r)
+		return
 	}
 
 	err = w.WriteMsg(msg)
@@ -155,48 +202,100 @@ func (d *ReqLogic) DNSReq(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
-// Additional DNS request handlers (handleSOARequest, handleARequest, handleAAAARequest, etc.)
-func handleSOARequest(msg *dns.Msg, q dns.Question) {
-	soa := &dns.SOA{
+// answerQuestion adds the static and dynamic records for q to the answer.
+func (d *ReqLogic) answerQuestion(msg *dns.Msg, q dns.Question, z *zone.Zone) {
+	// SOA and NS only exist at the apex
+	apex := z.Parse(q.Name).Kind == zone.NameApex
+
+	msg.Answer = append(msg.Answer, z.Records().Answer(q.Name, q.Qtype)...)
+
+	switch q.Qtype {
+	case dns.TypeSOA:
+		if apex {
+			d.handleSOARequest(msg, q, z)
+		}
+	case dns.TypeTXT:
+		d.handleTXTRequest(msg, q, z)
+	case dns.TypeNS:
+		if apex {
+			handleNSRequest(msg, q, z, d.settings.StaticTTL)
+		}
+	case dns.TypeSRV:
+		d.handleSRVRequest(msg, q, z)
+	case dns.TypePTR:
+		d.handlePTRRequest(msg, q, z)
+	case dns.TypeA, dns.TypeAAAA:
+		d.handleNodeAddressRequest(msg, q, z)
+	case dns.TypeDNSKEY:
+		d.handleDNSKEYRequest(msg, q, z)
+	}
+}
+
+// Additional DNS request handlers (handleSOARequest, handleNSRequest, handleTXTRequest, etc.)
+func (d *ReqLogic) handleSOARequest(msg *dns.Msg, q dns.Question, z *zone.Zone) {
+	soa := d.newSOA(z)
+	soa.Hdr.Name = utils.ToLowerCase(q.Name)
+	msg.Answer = append(msg.Answer, soa)
+}
+
+// newSOA returns the SOA of z with the current serial, the minimum is the TTL of negative answers (RFC 2308).
+func (d *ReqLogic) newSOA(z *zone.Zone) *dns.SOA {
+	return &dns.SOA{
 		Hdr: dns.RR_Header{
-			Name:   utils.ToLowerCase(q.Name),
+			Name:   z.Apex,
 			Rrtype: dns.TypeSOA,
 			Class:  dns.ClassINET,
-			Ttl:    300,
+			Ttl:    d.settings.StaticTTL,
 		},
-		Ns:      "pathfinderbeacon-ns1.heidenstedt.org.",
-		Mbox:    "hostmaster-pathfinderbeacon-net.heidenstedt.org.",
-		Serial:  uint32(time.Now().Unix()),
+		Ns:      z.Nameservers[0],
+		Mbox:    z.Hostmaster,
+		Serial:  d.serial.Load(),
 		Refresh: 7200,
 		Retry:   3600,
 		Expire:  1209600,
-		Minttl:  300,
+		Minttl:  d.settings.NegativeTTL,
 	}
-	msg.Answer = append(msg.Answer, soa)
 }
 
-func handleNSRequest(msg *dns.Msg, q dns.Question) {
-	ns := &dns.NS{
-		Hdr: dns.RR_Header{
-			Name:   utils.ToLowerCase(q.Name),
-			Rrtype: dns.TypeNS,
-			Class:  dns.ClassINET,
-			Ttl:    300,
-		},
-		Ns: "pathfinderbeacon-ns1.heidenstedt.org.",
+// handleNSRequest answers the nameservers of the zone, the addresses of nameservers
+// in the zone are added as glue from the static records.
+func handleNSRequest(msg *dns.Msg, q dns.Question, z *zone.Zone, ttl uint32) {
+	for _, nameserver := range z.Nameservers {
+		ns := &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   utils.ToLowerCase(q.Name),
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ns: nameserver,
+		}
+		msg.Answer = append(msg.Answer, ns)
+
+		if z.Contains(nameserver) {
+			msg.Extra = append(msg.Extra, z.Records().Get(nameserver, dns.TypeA)...)
+			msg.Extra = append(msg.Extra, z.Records().Get(nameserver, dns.TypeAAAA)...)
+		}
 	}
-	msg.Answer = append(msg.Answer, ns)
 }
 
-func (d *ReqLogic) handleTXTRequest(msg *dns.Msg, q dns.Question) {
+func (d *ReqLogic) handleTXTRequest(msg *dns.Msg, q dns.Question, z *zone.Zone) {
+	qName := utils.ToLowerCase(q.Name)
 
-	var requestType string
+	if name := z.Parse(qName); len(name.Labels) == 3 {
+		d.handleDNSSDInstanceTXT(msg, q, name)
+		return
+	}
+
+	var requestType, suffix string
 	switch {
-	case strings.HasSuffix(q.Name, "room.pathfinderbeacon.net."):
+	case strings.HasSuffix(qName, z.RoomSuffix):
 		requestType = "room"
-	case strings.HasSuffix(q.Name, "node.pathfinderbeacon.net."):
+		suffix = z.RoomSuffix
+	case strings.HasSuffix(qName, z.NodeSuffix):
 		requestType = "node"
-	case strings.HasSuffix(q.Name, "auth.pathfinderbeacon.net."):
+		suffix = z.NodeSuffix
+	case strings.HasSuffix(qName, z.AuthSuffix):
 		handleTxtAuthRequest(msg, q)
 		return
 
@@ -204,38 +303,50 @@ func (d *ReqLogic) handleTXTRequest(msg *dns.Msg, q dns.Question) {
 		return
 	}
 
-	name, ok := utils.GetDNSParameterAndCheckIfSha224(q.Name)
+	name, ok := utils.GetDNSParameterAndCheckIfSha224(qName, suffix)
 	if !ok {
 		msg.Rcode = dns.RcodeNameError
 		return
 	}
 
-	values, err := d.GetValues(requestType + ":" + name)
+	entries, err := d.GetEntries(requestType + ":" + name)
 	if err != nil {
-		d.logger.Error("Failed to get values", zap.Error(err))
+		if !errors.Is(err, cache.ErrNotFound) {
+			d.logger.Error("Failed to get values", zap.Error(err))
+		}
 		return
 	}
 
-	ttl := uint32(300)
+	maxTTL := d.settings.RoomTTL
 
 	if requestType == "node" {
-		ttl = 3600
+		maxTTL = d.settings.NodeTTL
 	}
 
-	for _, value := range values {
+	now := time.Now()
+	for _, entry := range entries {
 		txt := &dns.TXT{
 			Hdr: dns.RR_Header{
 				Name:   utils.ToLowerCase(q.Name),
 				Rrtype: dns.TypeTXT,
 				Class:  dns.ClassINET,
-				Ttl:    ttl,
+				Ttl:    answerTTL(entry, maxTTL, now),
 			},
-			Txt: []string{value},
+			Txt: []string{entry.Value},
 		}
 		msg.Answer = append(msg.Answer, txt)
 	}
 }
 
+// answerTTL caps the TTL of an answer to the remaining lifetime of the entry.
+func answerTTL(entry cache.Entry, maxTTL uint32, now time.Time) uint32 {
+	remaining := entry.Remaining(now)
+	if remaining == 0 || remaining > maxTTL {
+		return maxTTL
+	}
+	return remaining
+}
+
 func handleTxtAuthRequest(msg *dns.Msg, q dns.Question) {
 	// Create the TXT record
 	txt := &dns.TXT{
@@ -251,42 +362,6 @@ func handleTxtAuthRequest(msg *dns.Msg, q dns.Question) {
 
 }
 
-func GenerateClientCookie() []byte {
-	// In a real-world scenario, this should be a securely generated value
-	// For simplicity, we use a fixed value here
-	return []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
-}
-
-func handleARequest(msg *dns.Msg, q dns.Question) {
-	a := &dns.A{
-		Hdr: dns.RR_Header{
-			Name:   utils.ToLowerCase(q.Name),
-			Rrtype: dns.TypeA,
-			Class:  dns.ClassINET,
-			Ttl:    300,
-		},
-		A: net.ParseIP("128.140.37.196"),
-	}
-	msg.Answer = append(msg.Answer, a)
-}
-
-func handleAAAARequest(msg *dns.Msg, q dns.Question) {
-	aaaa := &dns.AAAA{
-		Hdr: dns.RR_Header{
-			Name:   utils.ToLowerCase(q.Name),
-			Rrtype: dns.TypeAAAA,
-			Class:  dns.ClassINET,
-			Ttl:    300,
-		},
-		AAAA: net.ParseIP("2a01:4f8:1c0c:68c1::1"),
-	}
-	msg.Answer = append(msg.Answer, aaaa)
-}
-
-func handleNotImplemented(msg *dns.Msg) {
-	msg.Rcode = dns.RcodeNotImplemented
-}
-
 func IsUDPRequest(addr net.Addr) bool {
 	switch addr.(type) {
 	case *net.UDPAddr:
@@ -0,0 +1,199 @@
+package reqLogic
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"github.com/miekg/dns"
+)
+
+// DNS-SD (RFC 6763) view of a room, the room name <room>.room.<zone> is the browsing domain:
+//
+//	_services._dns-sd._udp.<room>  PTR  _pathfinder._tcp.<room>       service types with nodes
+//	_pathfinder._tcp.<room>        PTR  <node>._pathfinder._tcp.<room> one instance per node
+//	<node>._pathfinder._tcp.<room> SRV  <port> <ip>.<node>.node.<zone> one per address
+//	<node>._pathfinder._tcp.<room> TXT  "txtvers=1" "node=<node>" ...
+const dnssdService = "_pathfinder"
+
+var dnssdProtocols = map[string]string{
+	"_tcp": "tcp",
+	"_udp": "udp",
+}
+
+// dnssdInstance is a node in a room with the addresses of one protocol.
+type dnssdInstance struct {
+	node      string
+	ttl       uint32
+	addresses []nodeAddress
+}
+
+// dnssdInstances returns the nodes of a room that have addresses with the given protocol.
+func (d *ReqLogic) dnssdInstances(room string, protocol string) []dnssdInstance {
+	now := time.Now()
+
+	var instances []dnssdInstance
+	for _, member := range d.getRoomNodes(room) {
+		instance := dnssdInstance{
+			node: member.Value,
+			ttl:  answerTTL(member, d.settings.RoomTTL, now),
+		}
+		for _, addr := range d.getNodeAddresses(member.Value) {
+			if addr.Address.Protocol == protocol {
+				instance.addresses = append(instance.addresses, addr)
+			}
+		}
+		if len(instance.addresses) > 0 {
+			instances = append(instances, instance)
+		}
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].node < instances[j].node })
+	return instances
+}
+
+// handlePTRRequest answers the DNS-SD browsing queries of a room.
+func (d *ReqLogic) handlePTRRequest(msg *dns.Msg, q dns.Question, z *zone.Zone) {
+	name := z.Parse(q.Name)
+	if name.Kind != zone.NameRoom || !utils.CheckIfSha224(name.ID) {
+		return
+	}
+
+	owner := utils.ToLowerCase(q.Name)
+	domain := z.RoomName(name.ID)
+	labels := strings.Join(name.Labels, ".")
+
+	switch {
+	case labels == "b._dns-sd._udp" || labels == "lb._dns-sd._udp":
+		// the room is its own browsing domain
+		msg.Answer = append(msg.Answer, newPTR(owner, domain, d.settings.RoomTTL))
+
+	case labels == "_services._dns-sd._udp":
+		for _, protoLabel := range []string{"_tcp", "_udp"} {
+			if len(d.dnssdInstances(name.ID, dnssdProtocols[protoLabel])) > 0 {
+				msg.Answer = append(msg.Answer, newPTR(owner, dnssdService+"."+protoLabel+"."+domain, d.settings.RoomTTL))
+			}
+		}
+
+	case len(name.Labels) == 2 && name.Labels[0] == dnssdService && dnssdProtocols[name.Labels[1]] != "":
+		for _, instance := range d.dnssdInstances(name.ID, dnssdProtocols[name.Labels[1]]) {
+			msg.Answer = append(msg.Answer, newPTR(owner, instance.node+"."+owner, instance.ttl))
+		}
+	}
+}
+
+// dnssdInstanceName returns the node and protocol of a DNS-SD instance name or false.
+func dnssdInstanceName(name zone.Name) (string, string, bool) {
+	if name.Kind != zone.NameRoom || len(name.Labels) != 3 || name.Labels[1] != dnssdService {
+		return "", "", false
+	}
+
+	protocol := dnssdProtocols[name.Labels[2]]
+	if protocol == "" || !utils.CheckIfSha224(name.Labels[0]) || !utils.CheckIfSha224(name.ID) {
+		return "", "", false
+	}
+
+	return name.Labels[0], protocol, true
+}
+
+// findDNSSDInstance returns the instance of a node in a room or false if the node is not in the room.
+func (d *ReqLogic) findDNSSDInstance(room string, node string, protocol string) (dnssdInstance, bool) {
+	for _, instance := range d.dnssdInstances(room, protocol) {
+		if instance.node == node {
+			return instance, true
+		}
+	}
+	return dnssdInstance{}, false
+}
+
+// handleDNSSDInstanceSRV answers SRV queries for <node>._pathfinder._proto.<room>.room.<zone>.
+func (d *ReqLogic) handleDNSSDInstanceSRV(msg *dns.Msg, q dns.Question, z *zone.Zone, name zone.Name) {
+	node, protocol, ok := dnssdInstanceName(name)
+	if !ok {
+		return
+	}
+
+	instance, ok := d.findDNSSDInstance(name.ID, node, protocol)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	for _, addr := range instance.addresses {
+		ip := net.ParseIP(addr.Address.Ip)
+		if ip == nil {
+			continue
+		}
+		target := addressTarget(z, node, ip)
+
+		srv := &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   utils.ToLowerCase(q.Name),
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+				Ttl:    min(instance.ttl, answerTTL(addr.Entry, d.settings.RoomTTL, now)),
+			},
+			Priority: 10,
+			Weight:   10,
+			Port:     uint16(addr.Address.Port),
+			Target:   target,
+		}
+		msg.Answer = append(msg.Answer, srv)
+		msg.Extra = append(msg.Extra, d.nodeAddressRecords(target, node, addressType(ip), ip)...)
+	}
+	msg.Answer = dns.Dedup(msg.Answer, nil)
+	msg.Extra = dns.Dedup(msg.Extra, nil)
+}
+
+// handleDNSSDInstanceTXT answers TXT queries for <node>._pathfinder._proto.<room>.room.<zone>
+// with key/value metadata of the node.
+func (d *ReqLogic) handleDNSSDInstanceTXT(msg *dns.Msg, q dns.Question, name zone.Name) {
+	node, protocol, ok := dnssdInstanceName(name)
+	if !ok {
+		return
+	}
+
+	instance, ok := d.findDNSSDInstance(name.ID, node, protocol)
+	if !ok {
+		return
+	}
+
+	// keys must be unique (RFC 6763 6.4), so all addresses are in one comma separated value
+	addresses := make([]string, 0, len(instance.addresses))
+	for _, addr := range instance.addresses {
+		addresses = append(addresses, addr.Entry.Value)
+	}
+
+	txt := []string{
+		"txtvers=1",
+		"node=" + node,
+		"room=" + name.ID,
+		"protocol=" + protocol,
+		"addresses=" + strings.Join(addresses, ","),
+	}
+
+	msg.Answer = append(msg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   utils.ToLowerCase(q.Name),
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    instance.ttl,
+		},
+		Txt: txt,
+	})
+}
+
+func newPTR(owner string, target string, ttl uint32) *dns.PTR {
+	return &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ptr: target,
+	}
+}
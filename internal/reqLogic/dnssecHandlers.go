@@ -0,0 +1,81 @@
+package reqLogic
+
+import (
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/dnssec"
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// signer returns the DNSSEC signer of z or nil if the zone is not signed.
+func (d *ReqLogic) signer(z *zone.Zone) *dnssec.Signer {
+	return d.settings.Signers[z.Apex]
+}
+
+func (d *ReqLogic) handleDNSKEYRequest(msg *dns.Msg, q dns.Question, z *zone.Zone) {
+	signer := d.signer(z)
+	if signer == nil || z.Parse(q.Name).Kind != zone.NameApex {
+		return
+	}
+	msg.Answer = append(msg.Answer, signer.DNSKEYs(d.settings.StaticTTL)...)
+}
+
+// signResponse adds the RRSIG records to msg if the client set the DO bit and z is signed.
+// Empty answers get a "black lies" NSEC record, so missing rooms and nodes are answered
+// with NODATA instead of NXDOMAIN and no zone walking is possible.
+func (d *ReqLogic) signResponse(msg *dns.Msg, r *dns.Msg, q dns.Question, z *zone.Zone) {
+	opt := r.IsEdns0()
+	if opt == nil || !opt.Do() || z == nil {
+		return
+	}
+	signer := d.signer(z)
+	if signer == nil {
+		return
+	}
+
+	if len(msg.Answer) == 0 && (msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError) {
+		var types []uint16
+		if msg.Rcode == dns.RcodeSuccess {
+			types = append(nameTypes(z.Parse(q.Name)), z.Records().Types(q.Name)...)
+		}
+
+		// the SOA is already in the authority section, see negativeResponse
+		msg.Rcode = dns.RcodeSuccess
+		msg.Ns = append(msg.Ns, dnssec.DenialOfExistence(utils.ToLowerCase(q.Name), q.Qtype, types, min(d.settings.StaticTTL, d.settings.NegativeTTL)))
+	}
+
+	now := time.Now()
+	var err error
+	for _, section := range []*[]dns.RR{&msg.Answer, &msg.Ns, &msg.Extra} {
+		*section, err = signer.Sign(*section, now)
+		if err != nil {
+			d.logger.Error("Failed to sign response", zap.Error(err))
+			msg.Answer, msg.Ns = nil, nil
+			msg.Rcode = dns.RcodeServerFailure
+			return
+		}
+	}
+}
+
+// nameTypes returns the types of the dynamic records that can exist at an existing name.
+func nameTypes(name zone.Name) []uint16 {
+	switch name.Kind {
+	case zone.NameApex:
+		return []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY}
+	case zone.NameRoom:
+		if len(name.Labels) == 0 {
+			return []uint16{dns.TypeTXT}
+		}
+		return []uint16{dns.TypeTXT, dns.TypeSRV, dns.TypePTR}
+	case zone.NameNode:
+		return []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT}
+	case zone.NameAuth:
+		return []uint16{dns.TypeTXT}
+	default:
+		// static names and empty non-terminals
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package reqLogic
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// dohResponseWriter lets DNSReq answer DNS over HTTPS requests, it keeps the message instead of sending it.
+// The remote address is a TCP address, so answers are never truncated and the TCP rules apply.
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	raw    []byte // the request as received, for SIG(0)
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *dohResponseWriter) Write(raw []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(raw), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return errDoHTsig }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// TSIG signatures are not checked for DNS over HTTPS, so they are never valid
+var errDoHTsig = errors.New("TSIG is not supported over DNS over HTTPS")
+
+// DoHHandler serves DNS over HTTPS (RFC 8484) on /dns-query with GET ?dns=<base64url> and POST application/dns-message.
+func (d *ReqLogic) DoHHandler(w http.ResponseWriter, r *http.Request) {
+	var raw []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		raw, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(raw) == 0 {
+			http.Error(w, "Invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		raw, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(raw); err != nil {
+		http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	host, err := getClientHost(r)
+	if err != nil {
+		http.Error(w, "Failed to get client host", http.StatusInternalServerError)
+		return
+	}
+	_, port, _ := net.SplitHostPort(r.RemoteAddr)
+	remotePort, _ := strconv.Atoi(port)
+
+	writer := &dohResponseWriter{
+		local:  &net.TCPAddr{},
+		remote: &net.TCPAddr{IP: net.ParseIP(host), Port: remotePort},
+		raw:    raw,
+	}
+	if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		writer.local = localAddr
+	}
+
+	d.DNSReq(writer, req)
+
+	// DNSReq does not answer if the client is rate limited
+	if writer.msg == nil {
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	packed, err := writer.msg.Pack()
+	if err != nil {
+		http.Error(w, "Failed to pack DNS message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(writer.msg)))
+	w.Write(packed)
+}
+
+// minTTL returns the smallest TTL of the answer and authority records, used as HTTP cache lifetime.
+// For negative answers with a SOA the lifetime is capped by the SOA minimum (RFC 2308).
+func minTTL(msg *dns.Msg) uint32 {
+	var ttl uint32
+	found := false
+
+	for _, rr := range append(append([]dns.RR{}, msg.Answer...), msg.Ns...) {
+		hdrTTL := rr.Header().Ttl
+		if soa, ok := rr.(*dns.SOA); ok && len(msg.Answer) == 0 {
+			hdrTTL = min(hdrTTL, soa.Minttl)
+		}
+		if !found || hdrTTL < ttl {
+			ttl = hdrTTL
+			found = true
+		}
+	}
+
+	return ttl
+}
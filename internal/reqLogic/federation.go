@@ -0,0 +1,496 @@
+package reqLogic
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"github.com/sethvargo/go-limiter"
+	"go.uber.org/zap"
+)
+
+const (
+	federationRecordsPath = "/v1/federation/records"
+
+	maxRecordsPerNode  = 20   // newest signed records kept per node to detect replays and for pulls
+	maxRecordsPerBatch = 1000 // records per push
+)
+
+// signedRecord is a v2 registration or deregistration as the node sent it. Every beacon can verify it
+// with the room key, so it can be passed on by beacons of other operators without trusting them.
+type signedRecord struct {
+	Action       string                `json:"action"`
+	Registration utils.RegisteringNode `json:"registration"`
+}
+
+type recordBatch struct {
+	Records []signedRecord `json:"records"`
+}
+
+// queuedRecord is a record that is sent to all peers except the one it came from.
+type queuedRecord struct {
+	record signedRecord
+	from   string
+}
+
+// federation exchanges signed records with the beacons of other operators.
+type federation struct {
+	peers   []string
+	secrets [][]byte // HMAC secret of every peer
+	client  *http.Client
+	limits  limiter.Store // records per peer
+	nonces  *nonceCache   // nonces of the received requests
+
+	mu    sync.Mutex
+	queue []queuedRecord
+}
+
+func newFederation(peers []string, secrets [][]byte, limits limiter.Store) *federation {
+	return &federation{
+		peers:   peers,
+		secrets: secrets,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		limits:  limits,
+		nonces:  newNonceCache(100000, 100000),
+	}
+}
+
+func (f *federation) enqueue(record signedRecord, from string) {
+	f.mu.Lock()
+	f.queue = append(f.queue, queuedRecord{record: record, from: from})
+	f.mu.Unlock()
+}
+
+func (f *federation) takeQueue() []queuedRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	queue := f.queue
+	f.queue = nil
+	return queue
+}
+
+func signedRecordsKey(room string, node string) string {
+	return "signed:" + room + ":" + node
+}
+
+// highWaterKey holds the timestamp of the newest record of a node. It is kept until every older record
+// expired, so an old record can not be replayed after the newer records of the node are gone.
+func highWaterKey(room string, node string) string {
+	return "highwater:" + room + ":" + node
+}
+
+// highWater returns the timestamp of the newest record of a node in milliseconds. The caller must hold the lock.
+func (d *ReqLogic) highWater(room string, node string, now time.Time) (int64, error) {
+	entries, err := d.loadEntries(highWaterKey(room, node), now)
+	if err != nil {
+		return 0, err
+	}
+
+	// a restored snapshot can add a second mark, the newer one wins
+	mark := int64(0)
+	for _, entry := range entries {
+		mark = max(mark, entry.Updated)
+	}
+	return mark, nil
+}
+
+// raiseHighWater sets the high-water mark of a node to the timestamp of a new record. A record older
+// than the mark expires at most federation.maxLifetime after the mark, so the mark lives that long.
+// The caller must hold the lock.
+func (d *ReqLogic) raiseHighWater(room string, node string, timestamp int64, now time.Time) error {
+	mark, err := d.highWater(room, node, now)
+	if err != nil || mark >= timestamp*1000 {
+		return err
+	}
+
+	expires := time.Unix(timestamp, 0).Add(d.settings.FederationMaxLifetime).Unix()
+	return d.saveEntries(highWaterKey(room, node), []cache.Entry{{Expires: expires, Updated: timestamp * 1000}}, now)
+}
+
+// gossipable reports whether a verified registration can be passed on to other beacons. The node
+// name has to be chosen by the node, a name derived from its IP can not be verified by others.
+func (d *ReqLogic) gossipable(regNode utils.RegisteringNode) bool {
+	return regNode.Version == 2 && regNode.Expires != 0 && signedNodeName(regNode) != "" &&
+		time.Duration(regNode.Expires-regNode.Timestamp)*time.Second <= d.settings.FederationMaxLifetime
+}
+
+// publishRecord sends a registration that was verified by this beacon to the peers.
+func (d *ReqLogic) publishRecord(action string, regNode utils.RegisteringNode) {
+	if d.federation == nil || !d.gossipable(regNode) {
+		return
+	}
+
+	record := signedRecord{Action: action, Registration: regNode}
+	if d.addRecord(record, signedNodeName(regNode), time.Now()) {
+		d.federation.enqueue(record, "")
+	}
+}
+
+// verifyRecord checks a record of a peer like a registration and returns the node name.
+// The nonce is not used up, replays are detected by the stored records of the node.
+func (d *ReqLogic) verifyRecord(record signedRecord, now time.Time) (string, error) {
+	regNode := record.Registration
+	if record.Action != utils.ActionRegister && record.Action != utils.ActionDeregister {
+		return "", fmt.Errorf("unknown action %q", record.Action)
+	}
+	if !d.gossipable(regNode) {
+		return "", fmt.Errorf("record needs version 2, a node, and an expiry of at most %s after the timestamp", d.settings.FederationMaxLifetime)
+	}
+
+	if !utils.CheckIfSha224(regNode.Room) {
+		return "", fmt.Errorf("room is not a valid sha224 hash")
+	}
+	if len(regNode.Node) > 128 || len(regNode.Nonce) < 16 || len(regNode.Nonce) > 128 {
+		return "", fmt.Errorf("invalid node or nonce")
+	}
+	if len(regNode.Addresses) > 50 || (record.Action == utils.ActionRegister && len(regNode.Addresses) == 0) {
+		return "", fmt.Errorf("invalid number of addresses")
+	}
+	for _, addr := range regNode.Addresses {
+		if err := validateAddress(addr); err != nil {
+			return "", err
+		}
+	}
+
+	if time.Unix(regNode.Timestamp, 0).After(now.Add(d.settings.MaxClockSkew)) {
+		return "", fmt.Errorf("timestamp is in the future")
+	}
+	if regNode.Expires <= now.Unix() {
+		return "", fmt.Errorf("record is expired")
+	}
+
+	if _, err := verifyRegistrationSignatures(regNode, record.Action); err != nil {
+		return "", err
+	}
+
+	return signedNodeName(regNode), nil
+}
+
+// recordIsNew reports whether a record is not stored and not older than the newest record of its node.
+func (d *ReqLogic) recordIsNew(record signedRecord, now time.Time) bool {
+	node := signedNodeName(record.Registration)
+	if node == "" {
+		return true
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return false
+	}
+	updated := record.Registration.Timestamp * 1000
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	mark, err := d.highWater(record.Registration.Room, node, now)
+	if err != nil || updated < mark {
+		return false
+	}
+	entries, err := d.loadEntries(signedRecordsKey(record.Registration.Room, node), now)
+	return err == nil && !knownRecord(entries, string(value), updated)
+}
+
+// knownRecord reports whether value is one of the stored records or older than the newest of them.
+func knownRecord(entries []cache.Entry, value string, updated int64) bool {
+	for _, entry := range entries {
+		if entry.Value == value || entry.Updated > updated {
+			return true
+		}
+	}
+	return false
+}
+
+// addRecord stores a verified record of node, it returns false if the record is known or older than
+// the high-water mark of the node. A deregistration of the whole node replaces the older records.
+func (d *ReqLogic) addRecord(record signedRecord, node string, now time.Time) bool {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return false
+	}
+	updated := record.Registration.Timestamp * 1000
+
+	room := record.Registration.Room
+	key := signedRecordsKey(room, node)
+
+	// the records and the high-water mark are written at once
+	added := false
+	err = d.update(func(_ time.Time) error {
+		mark, err := d.highWater(room, node, now)
+		if err != nil || updated < mark {
+			return err
+		}
+		entries, err := d.loadEntries(key, now)
+		if err != nil || knownRecord(entries, string(value), updated) {
+			return err
+		}
+
+		if record.Action == utils.ActionDeregister && len(record.Registration.Addresses) == 0 {
+			entries = slices.DeleteFunc(entries, func(e cache.Entry) bool { return e.Updated < updated })
+		}
+		entries = append(entries, cache.Entry{Value: string(value), Expires: record.Registration.Expires, Updated: updated})
+		slices.SortStableFunc(entries, func(a, b cache.Entry) int { return cmp.Compare(a.Updated, b.Updated) })
+		if len(entries) > maxRecordsPerNode {
+			entries = entries[len(entries)-maxRecordsPerNode:]
+		}
+
+		if err := d.saveEntries(key, entries, now); err != nil {
+			return err
+		}
+		added = true
+		return d.raiseHighWater(room, node, record.Registration.Timestamp, now)
+	})
+	if err != nil {
+		d.logger.Error("Failed to save signed record", zap.String("key", key), zap.Error(err))
+		return false
+	}
+	return added
+}
+
+// applyRecord registers or deregisters the node of a record of a peer.
+func (d *ReqLogic) applyRecord(record signedRecord, node string, now time.Time) error {
+	regNode := record.Registration
+
+	addresses := make([]string, 0, len(regNode.Addresses))
+	for _, addr := range regNode.Addresses {
+		addresses = append(addresses, utils.FormatAddress(addr))
+	}
+
+	if record.Action == utils.ActionDeregister {
+		return d.DeregisterNode(regNode.Room, node, addresses, registrationTime(regNode))
+	}
+	ttl := min(d.settings.RegistrationTTL, int(regNode.Expires-now.Unix()))
+	return d.RegisterNode(regNode.Room, node, addresses, ttl, registrationTime(regNode))
+}
+
+// receiveRecords verifies, stores and applies the records of peer and passes new ones on to the other peers.
+// It stops with an error when the peer exceeds its rate limit.
+func (d *ReqLogic) receiveRecords(records []signedRecord, peer string) (int, error) {
+	// oldest first, newer records replace older ones of the same node
+	slices.SortStableFunc(records, func(a, b signedRecord) int {
+		return cmp.Compare(a.Registration.Timestamp, b.Registration.Timestamp)
+	})
+
+	accepted := 0
+	for _, record := range records {
+		// known records are skipped before the rate limit, so pulls of a large peer do not use it up
+		if !d.recordIsNew(record, time.Now()) {
+			continue
+		}
+
+		_, _, _, ok, err := d.federation.limits.Take(context.Background(), peer)
+		if err != nil {
+			return accepted, err
+		}
+		if !ok {
+			return accepted, fmt.Errorf("rate limit of peer %s exceeded", peer)
+		}
+
+		now := time.Now()
+		node, err := d.verifyRecord(record, now)
+		if err != nil {
+			d.logger.Debug("Rejected signed record", zap.String("peer", peer), zap.String("room", record.Registration.Room), zap.Error(err))
+			continue
+		}
+		if !d.addRecord(record, node, now) {
+			continue
+		}
+
+		if err := d.applyRecord(record, node, now); err != nil {
+			d.logger.Error("Failed to apply signed record", zap.String("peer", peer), zap.String("node", node), zap.Error(err))
+			continue
+		}
+		d.federation.enqueue(record, peer)
+		accepted++
+	}
+	return accepted, nil
+}
+
+// storedRecords returns all signed records that did not expire yet.
+func (d *ReqLogic) storedRecords() []signedRecord {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	now := time.Now()
+	var records []signedRecord
+	for _, key := range d.store.Keys("signed:") {
+		entries, _ := d.loadEntries(key, now)
+		for _, entry := range entries {
+			var record signedRecord
+			if err := json.Unmarshal([]byte(entry.Value), &record); err == nil {
+				records = append(records, record)
+			}
+		}
+	}
+	return records
+}
+
+// FederationRecordsHandler receives records pushed by a peer (POST) and returns all stored records to a peer (GET).
+// Only requests signed with the secret of a configured peer are allowed.
+func (d *ReqLogic) FederationRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	if d.federation == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	i, body, err := verifyPeerRequest(w, r, d.federation.secrets, d.federation.nonces, d.settings.MaxClockSkew)
+	if err != nil {
+		d.logger.Warn("Rejected federation request", zap.String("remote", r.RemoteAddr), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	peer := d.federation.peers[i]
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recordBatch{Records: d.storedRecords()})
+	case http.MethodPost:
+		var batch recordBatch
+		if err := json.Unmarshal(body, &batch); err != nil {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		if len(batch.Records) > maxRecordsPerBatch {
+			http.Error(w, "Too many records", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		accepted, err := d.receiveRecords(batch.Records, peer)
+		if err != nil {
+			d.logger.Warn("Stopped receiving signed records", zap.String("peer", peer), zap.Int("accepted", accepted), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("X-Pathfinder-Accepted", strconv.Itoa(accepted))
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// federationRequest sends a request signed with the secret of the i-th peer.
+func (d *ReqLogic) federationRequest(ctx context.Context, method string, i int, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(d.federation.peers[i], "/")+federationRecordsPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := signPeerRequest(req, d.federation.secrets[i], body); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.federation.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("peer answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// pushRecords sends the queued records to the peers, a peer does not get its own records back.
+func (d *ReqLogic) pushRecords() {
+	queue := d.federation.takeQueue()
+	if len(queue) == 0 {
+		return
+	}
+
+	for i, peer := range d.federation.peers {
+		var records []signedRecord
+		for _, queued := range queue {
+			if queued.from != peer {
+				records = append(records, queued.record)
+			}
+		}
+
+		for len(records) > 0 {
+			n := min(len(records), maxRecordsPerBatch)
+			go d.pushBatch(i, records[:n])
+			records = records[n:]
+		}
+	}
+}
+
+func (d *ReqLogic) pushBatch(i int, records []signedRecord) {
+	body, err := json.Marshal(recordBatch{Records: records})
+	if err != nil {
+		d.logger.Error("Failed to encode signed records", zap.Error(err))
+		return
+	}
+
+	resp, err := d.federationRequest(context.Background(), http.MethodPost, i, body)
+	if err != nil {
+		d.logger.Warn("Failed to push signed records to peer", zap.String("peer", d.federation.peers[i]), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+}
+
+// pullRecords gets all records of the i-th peer, so records that were not pushed, e.g. during a restart, arrive too.
+func (d *ReqLogic) pullRecords(i int) {
+	peer := d.federation.peers[i]
+	resp, err := d.federationRequest(context.Background(), http.MethodGet, i, nil)
+	if err != nil {
+		d.logger.Warn("Failed to pull signed records from peer", zap.String("peer", peer), zap.Error(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	var batch recordBatch
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&batch); err != nil {
+		d.logger.Warn("Failed to decode signed records of peer", zap.String("peer", peer), zap.Error(err))
+		return
+	}
+
+	accepted, err := d.receiveRecords(batch.Records, peer)
+	if err != nil {
+		d.logger.Warn("Stopped receiving signed records", zap.String("peer", peer), zap.Int("accepted", accepted), zap.Error(err))
+	}
+	if accepted > 0 {
+		d.logger.Info("Pulled signed records of peer", zap.String("peer", peer), zap.Int("accepted", accepted))
+	}
+}
+
+// StartFederation pushes new records to the peers every pushInterval and pulls the records
+// of every peer every pullInterval, starting right away.
+func (d *ReqLogic) StartFederation(pushInterval time.Duration, pullInterval time.Duration) {
+	if d.federation == nil {
+		return
+	}
+
+	push := time.NewTicker(pushInterval)
+	defer push.Stop()
+	pull := time.NewTicker(pullInterval)
+	defer pull.Stop()
+
+	pullAll := func() {
+		for i := range d.federation.peers {
+			d.pullRecords(i)
+		}
+	}
+
+	pullAll()
+	for {
+		select {
+		case <-push.C:
+			d.pushRecords()
+		case <-pull.C:
+			pullAll()
+		}
+	}
+}
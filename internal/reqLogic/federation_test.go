@@ -0,0 +1,345 @@
+package reqLogic
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/auth"
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"go.uber.org/zap"
+)
+
+func newFederationTestLogic() *ReqLogic {
+	return &ReqLogic{
+		store:  cache.NewMemoryStore(),
+		logger: zap.NewNop(),
+		settings: Settings{
+			MaxClockSkew:          time.Minute,
+			FederationMaxLifetime: time.Hour,
+		},
+	}
+}
+
+// signRecord returns a record of node "node-1" signed with key, edit changes the registration before it is signed.
+func signRecord(t *testing.T, key *auth.Key, action string, timestamp time.Time, edit func(*utils.RegisteringNode)) signedRecord {
+	t.Helper()
+
+	regNode := utils.RegisteringNode{
+		Version:   2,
+		Room:      key.GetRoomName(),
+		PublicKey: key.PublicKeyToPemBase64(),
+		Addresses: []utils.RegisteringAddress{{Protocol: "tcp", Ip: "192.0.2.1", Port: 80}},
+		Timestamp: timestamp.Unix(),
+		Nonce:     "nonce-" + timestamp.Format("150405.000000000"),
+		Node:      "node-1",
+		Expires:   timestamp.Add(30 * time.Minute).Unix(),
+	}
+	if edit != nil {
+		edit(&regNode)
+	}
+
+	payload, err := regNode.CanonicalPayload(action)
+	if err != nil {
+		t.Fatalf("Failed to build payload: %v", err)
+	}
+	signature, err := key.SignPayload(payload)
+	if err != nil {
+		t.Fatalf("Failed to sign payload: %v", err)
+	}
+	regNode.RoomSignature = base64.StdEncoding.EncodeToString(signature)
+
+	return signedRecord{Action: action, Registration: regNode}
+}
+
+func TestVerifyRecord(t *testing.T) {
+	key, err := auth.GenerateKeyWithAlgorithm(auth.AlgorithmEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := auth.GenerateKeyWithAlgorithm(auth.AlgorithmEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		action  string
+		edit    func(*utils.RegisteringNode) // before signing
+		tamper  func(*signedRecord)          // after signing
+		wantErr string
+	}{
+		{
+			name:   "valid registration",
+			action: utils.ActionRegister,
+		},
+		{
+			name:   "valid deregistration of the whole node",
+			action: utils.ActionDeregister,
+			edit:   func(r *utils.RegisteringNode) { r.Addresses = nil },
+		},
+		{
+			name:    "unknown action",
+			action:  "update",
+			wantErr: "unknown action",
+		},
+		{
+			name:    "without node",
+			action:  utils.ActionRegister,
+			edit:    func(r *utils.RegisteringNode) { r.Node = "" },
+			wantErr: "record needs version 2",
+		},
+		{
+			name:    "without expiry",
+			action:  utils.ActionRegister,
+			edit:    func(r *utils.RegisteringNode) { r.Expires = 0 },
+			wantErr: "record needs version 2",
+		},
+		{
+			name:    "lifetime above the maximum",
+			action:  utils.ActionRegister,
+			edit:    func(r *utils.RegisteringNode) { r.Expires = r.Timestamp + int64((2 * time.Hour).Seconds()) },
+			wantErr: "record needs version 2",
+		},
+		{
+			name:    "invalid room",
+			action:  utils.ActionRegister,
+			edit:    func(r *utils.RegisteringNode) { r.Room = "room" },
+			wantErr: "room is not a valid sha224 hash",
+		},
+		{
+			name:    "registration without addresses",
+			action:  utils.ActionRegister,
+			edit:    func(r *utils.RegisteringNode) { r.Addresses = nil },
+			wantErr: "invalid number of addresses",
+		},
+		{
+			name:    "invalid address",
+			action:  utils.ActionRegister,
+			edit:    func(r *utils.RegisteringNode) { r.Addresses[0].Port = 0 },
+			wantErr: "port is not valid",
+		},
+		{
+			name:    "timestamp in the future",
+			action:  utils.ActionRegister,
+			edit:    func(r *utils.RegisteringNode) { r.Timestamp = now.Add(10 * time.Minute).Unix() },
+			wantErr: "timestamp is in the future",
+		},
+		{
+			name:   "expired record",
+			action: utils.ActionRegister,
+			edit: func(r *utils.RegisteringNode) {
+				r.Timestamp = now.Add(-2 * time.Hour).Unix()
+				r.Expires = now.Add(-time.Hour).Unix()
+			},
+			wantErr: "record is expired",
+		},
+		{
+			name:    "changed addresses",
+			action:  utils.ActionRegister,
+			tamper:  func(r *signedRecord) { r.Registration.Addresses[0].Ip = "192.0.2.99" },
+			wantErr: "Failed to verify room signature",
+		},
+		{
+			name:    "changed action",
+			action:  utils.ActionRegister,
+			tamper:  func(r *signedRecord) { r.Action = utils.ActionDeregister },
+			wantErr: "Failed to verify room signature",
+		},
+		{
+			name:   "room of another key",
+			action: utils.ActionRegister,
+			tamper: func(r *signedRecord) {
+				r.Registration.PublicKey = other.PublicKeyToPemBase64()
+			},
+			wantErr: "room does not belong to the public key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFederationTestLogic()
+			record := signRecord(t, key, tt.action, now, tt.edit)
+			if tt.tamper != nil {
+				tt.tamper(&record)
+			}
+
+			node, err := d.verifyRecord(record, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if want := utils.NodeNameFromID(key.GetRoomName(), "node-1"); node != want {
+				t.Errorf("node = %q, want %q", node, want)
+			}
+		})
+	}
+}
+
+func TestAddRecord(t *testing.T) {
+	key, err := auth.GenerateKeyWithAlgorithm(auth.AlgorithmEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := key.GetRoomName()
+	node := utils.NodeNameFromID(room, "node-1")
+	now := time.Now()
+
+	type step struct {
+		action      string
+		age         time.Duration // of the timestamp
+		dropRecords bool          // delete the stored records of the node before the step
+		want        bool
+	}
+
+	tests := []struct {
+		name        string
+		steps       []step
+		wantRecords int
+	}{
+		{
+			name:        "new record is added",
+			steps:       []step{{action: utils.ActionRegister, age: time.Minute, want: true}},
+			wantRecords: 1,
+		},
+		{
+			name: "newer records are added",
+			steps: []step{
+				{action: utils.ActionRegister, age: 2 * time.Minute, want: true},
+				{action: utils.ActionRegister, age: time.Minute, want: true},
+			},
+			wantRecords: 2,
+		},
+		{
+			name: "older record is rejected",
+			steps: []step{
+				{action: utils.ActionRegister, age: time.Minute, want: true},
+				{action: utils.ActionRegister, age: 2 * time.Minute},
+			},
+			wantRecords: 1,
+		},
+		{
+			name: "deregistration of the node replaces older records",
+			steps: []step{
+				{action: utils.ActionRegister, age: 3 * time.Minute, want: true},
+				{action: utils.ActionRegister, age: 2 * time.Minute, want: true},
+				{action: utils.ActionDeregister, age: time.Minute, want: true},
+			},
+			wantRecords: 1,
+		},
+		{
+			name: "replay after the records are gone is rejected by the high-water mark",
+			steps: []step{
+				{action: utils.ActionRegister, age: 2 * time.Minute, want: true},
+				{action: utils.ActionDeregister, age: time.Minute, want: true},
+				{action: utils.ActionRegister, age: 2 * time.Minute, dropRecords: true},
+			},
+		},
+		{
+			name: "newer record after the records are gone is added",
+			steps: []step{
+				{action: utils.ActionRegister, age: 2 * time.Minute, want: true},
+				{action: utils.ActionRegister, age: time.Minute, dropRecords: true, want: true},
+			},
+			wantRecords: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFederationTestLogic()
+
+			records := make(map[time.Duration]signedRecord)
+			for i, s := range tt.steps {
+				if s.dropRecords {
+					d.store.Del([]byte(signedRecordsKey(room, node)))
+				}
+
+				// the same age is the same record, so replays are detected
+				record, ok := records[s.age]
+				if !ok || record.Action != s.action {
+					edit := func(r *utils.RegisteringNode) {
+						if s.action == utils.ActionDeregister {
+							r.Addresses = nil
+						}
+					}
+					record = signRecord(t, key, s.action, now.Add(-s.age), edit)
+					records[s.age] = record
+				}
+
+				if got := d.recordIsNew(record, now); got != s.want {
+					t.Errorf("step %d: recordIsNew = %v, want %v", i, got, s.want)
+				}
+				if got := d.addRecord(record, node, now); got != s.want {
+					t.Fatalf("step %d: addRecord = %v, want %v", i, got, s.want)
+				}
+			}
+
+			d.mu.RLock()
+			entries, err := d.loadEntries(signedRecordsKey(room, node), now)
+			d.mu.RUnlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.wantRecords {
+				t.Errorf("got %d stored records, want %d", len(entries), tt.wantRecords)
+			}
+		})
+	}
+}
+
+func TestVerifyRegistrationV2HighWater(t *testing.T) {
+	key, err := auth.GenerateKeyWithAlgorithm(auth.AlgorithmEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := key.GetRoomName()
+	node := utils.NodeNameFromID(room, "node-1")
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		gossiped   time.Duration // age of the deregistration gossiped by another beacon, 0 for none
+		age        time.Duration // of the registration
+		noExpiry   bool          // the registration is not gossipable
+		wantStatus int
+	}{
+		{name: "without gossiped record", age: 30 * time.Second, wantStatus: http.StatusOK},
+		{name: "newer than the gossiped record", gossiped: 30 * time.Second, age: 10 * time.Second, wantStatus: http.StatusOK},
+		{name: "replay older than the gossiped record", gossiped: 10 * time.Second, age: 30 * time.Second, wantStatus: http.StatusConflict},
+		{name: "not gossipable", gossiped: 10 * time.Second, age: 30 * time.Second, noExpiry: true, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFederationTestLogic()
+			d.nonces = newNonceCache(10, 10)
+
+			if tt.gossiped != 0 {
+				deregister := signRecord(t, key, utils.ActionDeregister, now.Add(-tt.gossiped), func(r *utils.RegisteringNode) { r.Addresses = nil })
+				if !d.addRecord(deregister, node, now) {
+					t.Fatal("gossiped record was not added")
+				}
+			}
+
+			record := signRecord(t, key, utils.ActionRegister, now.Add(-tt.age), func(r *utils.RegisteringNode) {
+				if tt.noExpiry {
+					r.Expires = 0
+				}
+			})
+			status, err := d.verifyRegistrationV2(record.Registration, utils.ActionRegister, "192.0.2.1", now)
+			if status != tt.wantStatus {
+				t.Errorf("status = %d (%v), want %d", status, err, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -2,57 +2,332 @@ package reqLogic
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/i5heu/PathfinderBeacon/pkg/cache"
-	"github.com/i5heu/PathfinderBeacon/pkg/utils"
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
 )
 
-func (d *ReqLogic) AddValue(key string, value string, ttl int) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// AddValue adds value to key or refreshes its expiry, every value expires on its own.
+// A ttl of 0 means the value never expires. updated is the time of the change, for signed
+// registrations the signed timestamp, so replicas order changes the same way wherever they arrive.
+func (d *ReqLogic) AddValue(key string, value string, ttl int, updated time.Time) error {
+	return d.update(func(now time.Time) error {
+		return d.addValue(key, value, ttl, updated, now)
+	})
+}
+
+// addValue is AddValue for a caller that holds the lock.
+func (d *ReqLogic) addValue(key string, value string, ttl int, updated time.Time, now time.Time) error {
+	// get existing entries so we can append to them
+	entries, err := d.loadEntries(key, now)
+	if err != nil {
+		return err
+	}
 
-	// get existing values so we can append to them
-	var values []string
-	existingValue, err := d.store.Get([]byte(key))
-	if err == nil {
-		if err := json.Unmarshal(existingValue, &values); err != nil {
+	if d.replication != nil {
+		// a newer removal wins, e.g. over a replayed registration
+		removed, err := d.removedSince(key, value, updated, now)
+		if err != nil || removed {
 			return err
 		}
 	}
 
-	values = append(values, value)
-	values = utils.RemoveDuplicate(values)
+	expires := int64(0)
+	if ttl > 0 {
+		expires = now.Unix() + int64(ttl)
+	}
+
+	found := false
+	for i := range entries {
+		if entries[i].Value == value {
+			entries[i].Expires = expires
+			entries[i].Updated = max(entries[i].Updated, updated.UnixMilli())
+			found = true
+		}
+	}
+	if !found {
+		entries = append(entries, cache.Entry{Value: value, Expires: expires, Updated: updated.UnixMilli()})
+		d.ZonesChanged()
+	}
 
-	data, err := json.Marshal(values)
-	if err != nil {
+	if d.replication != nil {
+		if err := d.removeTombstone(key, value, now); err != nil {
+			return err
+		}
+		d.replication.markDirty(key)
+	}
+
+	return d.saveEntries(key, entries, now)
+}
+
+// RemoveValues removes values from key, the other values keep their expiry. Values that were
+// added after updated are kept. The key is deleted if no values are left, which is reported by the returned bool.
+func (d *ReqLogic) RemoveValues(key string, remove []string, updated time.Time) (bool, error) {
+	var empty bool
+	err := d.update(func(now time.Time) error {
+		var err error
+		empty, err = d.removeValues(key, remove, updated, now)
 		return err
+	})
+	return empty, err
+}
+
+// removeValues is RemoveValues for a caller that holds the lock.
+func (d *ReqLogic) removeValues(key string, remove []string, updated time.Time, now time.Time) (bool, error) {
+	entries, err := d.loadEntries(key, now)
+	if err != nil {
+		return false, err
+	}
+
+	toRemove := make(map[string]bool, len(remove))
+	for _, value := range remove {
+		toRemove[value] = true
 	}
 
-	return d.store.Set([]byte(key), data, ttl)
+	var remaining, removed []cache.Entry
+	for _, entry := range entries {
+		if toRemove[entry.Value] && entry.Updated <= updated.UnixMilli() {
+			removed = append(removed, entry)
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+
+	if len(removed) > 0 {
+		d.ZonesChanged()
+		if err := d.addTombstones(key, removed, now, updated); err != nil {
+			return false, err
+		}
+	}
+
+	return len(remaining) == 0, d.saveEntries(key, remaining, now)
 }
 
-func (d *ReqLogic) GetValues(key string) ([]string, error) {
+// GetEntries returns the entries of key that are not expired yet.
+func (d *ReqLogic) GetEntries(key string) ([]cache.Entry, error) {
 	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	var values []string
 	data, err := d.store.Get([]byte(key))
+	d.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := cache.DecodeEntries(data)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal(data, &values); err != nil {
+	alive, pruned := cache.PruneEntries(entries, time.Now())
+	if pruned {
+		d.pruneKey(key)
+	}
+
+	return alive, nil
+}
+
+func (d *ReqLogic) GetValues(key string) ([]string, error) {
+	entries, err := d.GetEntries(key)
+	if err != nil {
 		return nil, err
 	}
 
+	values := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		values = append(values, entry.Value)
+	}
+
 	return values, nil
 }
 
+// StartPruner removes expired entries of all keys every interval.
+func (d *ReqLogic) StartPruner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.PruneAll()
+	}
+}
+
+func (d *ReqLogic) PruneAll() {
+	d.mu.RLock()
+	keys := d.store.Keys("")
+	d.mu.RUnlock()
+
+	for _, key := range keys {
+		d.pruneKey(key)
+	}
+
+	d.publishExpiredAddresses()
+}
+
+// publishExpiredAddresses tells the rooms of nodes with expired addresses about the change.
+func (d *ReqLogic) publishExpiredAddresses() {
+	changed := d.watch.takeChangedNodes()
+	if len(changed) == 0 {
+		return
+	}
+
+	d.mu.RLock()
+	roomKeys := d.store.Keys("room:")
+	d.mu.RUnlock()
+
+	for _, roomKey := range roomKeys {
+		members, _ := d.GetValues(roomKey)
+		for _, node := range members {
+			if _, ok := changed[node]; !ok {
+				continue
+			}
+			addresses, _ := d.GetValues("node:" + node)
+			d.watch.publish(strings.TrimPrefix(roomKey, "room:"), EventAddressChange, node, addresses)
+		}
+	}
+}
+
+func (d *ReqLogic) pruneKey(key string) {
+	d.mu.Lock()
+
+	data, err := d.store.Get([]byte(key))
+	if err != nil {
+		d.mu.Unlock()
+		return
+	}
+
+	entries, err := cache.DecodeEntries(data)
+	if err != nil {
+		d.mu.Unlock()
+		d.logger.Error("Failed to decode entries", zap.String("key", key), zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	alive, pruned := cache.PruneEntries(entries, now)
+	if !pruned {
+		d.mu.Unlock()
+		return
+	}
+
+	err = d.saveEntries(key, alive, now)
+	d.mu.Unlock()
+	// tombstones and signed records are not part of the zones
+	if strings.HasPrefix(key, "room:") || strings.HasPrefix(key, "node:") {
+		d.ZonesChanged()
+	}
+	if err != nil {
+		d.logger.Error("Failed to save entries", zap.String("key", key), zap.Error(err))
+		return
+	}
+
+	// tell watchers about the expired entries, outside of the lock
+	switch {
+	case strings.HasPrefix(key, "room:"):
+		for _, entry := range entries {
+			if entry.Expired(now) {
+				d.watch.publish(strings.TrimPrefix(key, "room:"), EventLeave, entry.Value, nil)
+			}
+		}
+	case strings.HasPrefix(key, "node:"):
+		d.watch.markNodeChanged(strings.TrimPrefix(key, "node:"))
+	}
+}
+
+// writeBatch collects the writes of update, so they are written at once.
+type writeBatch struct {
+	writes []cache.Write
+	index  map[string]int // position of every key in writes
+}
+
+func (b *writeBatch) add(key string, value []byte, ttl int) {
+	if i, ok := b.index[key]; ok {
+		b.writes[i] = cache.Write{Key: []byte(key), Value: value, TTL: ttl}
+		return
+	}
+	b.index[key] = len(b.writes)
+	b.writes = append(b.writes, cache.Write{Key: []byte(key), Value: value, TTL: ttl})
+}
+
+// update calls fn with the lock held and writes all entries that fn saves in one batch,
+// e.g. the room, the addresses and the tombstones of a registration. Nothing is written if fn fails.
+func (d *ReqLogic) update(fn func(now time.Time) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.batch = &writeBatch{index: make(map[string]int)}
+	defer func() { d.batch = nil }()
+
+	if err := fn(time.Now()); err != nil {
+		return err
+	}
+	if len(d.batch.writes) == 0 {
+		return nil
+	}
+	return cache.WriteBatch(d.store, d.batch.writes)
+}
+
+// get returns the value of key, including the writes of a running update. The caller must hold the lock.
+func (d *ReqLogic) get(key string) ([]byte, error) {
+	if d.batch != nil {
+		if i, ok := d.batch.index[key]; ok {
+			if d.batch.writes[i].Value == nil {
+				return nil, cache.ErrNotFound
+			}
+			return d.batch.writes[i].Value, nil
+		}
+	}
+	return d.store.Get([]byte(key))
+}
+
+// loadEntries returns the not expired entries of key, none if the key does not exist.
+// The caller must hold the lock.
+func (d *ReqLogic) loadEntries(key string, now time.Time) ([]cache.Entry, error) {
+	data, err := d.get(key)
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load %s: %v", key, err)
+	}
+
+	entries, err := cache.DecodeEntries(data)
+	if err != nil {
+		return nil, err
+	}
+
+	alive, _ := cache.PruneEntries(entries, now)
+	return alive, nil
+}
+
+// saveEntries stores entries with a key TTL that keeps the longest living entry,
+// an empty list deletes the key. Inside update it is written with the batch. The caller must hold the lock.
+func (d *ReqLogic) saveEntries(key string, entries []cache.Entry, now time.Time) error {
+	if len(entries) == 0 {
+		if d.batch != nil {
+			d.batch.add(key, nil, 0)
+			return nil
+		}
+		d.store.Del([]byte(key))
+		return nil
+	}
+
+	data, err := cache.EncodeEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	if d.batch != nil {
+		d.batch.add(key, data, cache.KeyTTL(entries, now))
+		return nil
+	}
+	return d.store.Set([]byte(key), data, cache.KeyTTL(entries, now))
+}
+
 func (d *ReqLogic) GetStats() cache.CacheStats {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
@@ -60,8 +335,9 @@ func (d *ReqLogic) GetStats() cache.CacheStats {
 	return d.store.GetStats()
 }
 
-func rateLimit(ctx context.Context, w dns.ResponseWriter, d *ReqLogic) error {
-	if IsUDPRequest(w.RemoteAddr()) {
+// rateLimit takes a token of the client, UDP clients with a valid server cookie get the TCP limits.
+func rateLimit(ctx context.Context, w dns.ResponseWriter, d *ReqLogic, validCookie bool) error {
+	if IsUDPRequest(w.RemoteAddr()) && !validCookie {
 		_, _, _, ok, err := d.rateLimitStoreUDP.Take(ctx, getIPFromRemoteAddr(w.RemoteAddr().String()))
 		if err != nil {
 			log.Printf("Failed to get rate limit: UDP %s\n", err)
@@ -73,7 +349,8 @@ func rateLimit(ctx context.Context, w dns.ResponseWriter, d *ReqLogic) error {
 		}
 		return nil
 	} else {
-		_, _, _, ok, err := d.rateLimitStoreUDP.Take(ctx, getIPFromRemoteAddr(w.RemoteAddr().String()))
+		// TCP, DNS over TLS, DNS over HTTPS and UDP with cookie
+		_, _, _, ok, err := d.rateLimitStoreTCP.Take(ctx, getIPFromRemoteAddr(w.RemoteAddr().String()))
 		if err != nil {
 			log.Printf("Failed to get rate limit TCP: %s\n", err)
 			return err
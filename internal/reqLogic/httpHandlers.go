@@ -10,12 +10,29 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/i5heu/PathfinderBeacon/pkg/auth"
 	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"go.uber.org/zap"
 )
 
 func validateAndParseRegisteringAddress(regString string) (utils.RegisteringNode, error) {
+	regAddr, err := parseRegisteringNode(regString)
+	if err != nil {
+		return utils.RegisteringNode{}, err
+	}
+
+	if len(regAddr.Addresses) == 0 {
+		return utils.RegisteringNode{}, fmt.Errorf("addresses are empty")
+	}
+
+	return regAddr, nil
+}
+
+// parseRegisteringNode parses and validates a registration body, the addresses may be empty.
+func parseRegisteringNode(regString string) (utils.RegisteringNode, error) {
 	if regString == "" {
 		return utils.RegisteringNode{}, fmt.Errorf("address is empty")
 	}
@@ -29,9 +46,6 @@ func validateAndParseRegisteringAddress(regString string) (utils.RegisteringNode
 	if regAddr.Room == "" {
 		return utils.RegisteringNode{}, fmt.Errorf("room is empty")
 	}
-	if len(regAddr.Addresses) == 0 {
-		return utils.RegisteringNode{}, fmt.Errorf("addresses are empty")
-	}
 	if len(regAddr.Addresses) > 50 {
 		return utils.RegisteringNode{}, fmt.Errorf("too many addresses")
 	}
@@ -40,120 +54,373 @@ func validateAndParseRegisteringAddress(regString string) (utils.RegisteringNode
 		return utils.RegisteringNode{}, fmt.Errorf("room is not a valid sha224 hash")
 	}
 
-	// check if ip is valid
 	for _, addr := range regAddr.Addresses {
-		if net.ParseIP(addr.Ip) == nil {
-			return utils.RegisteringNode{}, fmt.Errorf("ip is not valid: %s", addr.Ip)
+		if err := validateAddress(addr); err != nil {
+			return utils.RegisteringNode{}, err
 		}
 	}
 
-	// check if port is valid
-	for _, addr := range regAddr.Addresses {
-		if addr.Port < 1 || addr.Port > 65535 {
-			return utils.RegisteringNode{}, fmt.Errorf("port is not valid %d", addr.Port)
+	return regAddr, nil
+}
+
+// validateAddress checks the IP, port and protocol of a registered address.
+func validateAddress(addr utils.RegisteringAddress) error {
+	if net.ParseIP(addr.Ip) == nil {
+		return fmt.Errorf("ip is not valid: %s", addr.Ip)
+	}
+	if addr.Port < 1 || addr.Port > 65535 {
+		return fmt.Errorf("port is not valid %d", addr.Port)
+	}
+	if addr.Protocol != "tcp" && addr.Protocol != "udp" {
+		return fmt.Errorf("protocol is not valid %s", addr.Protocol)
+	}
+	return nil
+}
+
+// getClientHost returns the IP of the client, behind a private proxy the forwarded headers are used.
+// Headers without a valid IP fall back to the address of the proxy.
+func getClientHost(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", fmt.Errorf("Failed to split host port: %w", err)
+	}
+	parsedAddr := net.ParseIP(host)
+	if parsedAddr == nil {
+		return "", fmt.Errorf("Failed to parse IP %s", host)
+	}
+
+	// only a proxy in a private network, e.g. of docker, may set the client address
+	if !parsedAddr.IsPrivate() {
+		return host, nil
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String(), nil
+	}
+	if ip := forwardedFor(r.Header.Values("X-Forwarded-For")); ip != nil {
+		return ip.String(), nil
+	}
+	return host, nil
+}
+
+// forwardedFor returns the client of X-Forwarded-For headers, e.g. "203.0.113.7, 10.0.0.2".
+// Every proxy appends the address it got the request from and only private proxies are trusted,
+// so it is the rightmost public address. Addresses left of it could be set by the client.
+func forwardedFor(headers []string) net.IP {
+	var hops []string
+	for _, header := range headers {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !ip.IsPrivate() && !ip.IsLoopback() {
+			return ip
 		}
 	}
+	// only private hops, the leftmost of them is the client
+	return client
+}
 
-	// check if protocol is valid
-	for _, addr := range regAddr.Addresses {
-		if addr.Protocol != "tcp" && addr.Protocol != "udp" {
-			return utils.RegisteringNode{}, fmt.Errorf("protocol is not valid %s", addr.Protocol)
+// getNodeName returns the legacy node name which is derived from the client IP.
+func getNodeName(host string) string {
+	nodeName := sha512.Sum512_224([]byte("node:" + host))
+	return hex.EncodeToString(nodeName[:])
+}
+
+// verifyRegistration checks the room signature of a request and returns the name of the node
+// and the HTTP status to answer with on failure.
+// v1 requests sign only the room name, v2 requests sign the canonical payload and are protected against replays.
+// v2 nodes can name themselves, otherwise the name is derived from the client IP.
+func (d *ReqLogic) verifyRegistration(regNode utils.RegisteringNode, action string, host string, now time.Time) (string, int, error) {
+	if regNode.Version < 2 {
+		if !d.settings.AllowV1Registration {
+			return "", http.StatusBadRequest, fmt.Errorf("v1 registrations are disabled, use version 2")
+		}
+		d.logger.Warn("v1 registrations are deprecated, they can be replayed forever. Set registration.allowV1 to false once all clients use version 2",
+			zap.String("room", regNode.Room), zap.String("host", host))
+
+		// like for v2 the room has to belong to the key, otherwise any key could write to any room
+		roomName, err := auth.RoomNameFromPublicKey(regNode.PublicKey)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		if roomName != regNode.Room {
+			return "", http.StatusUnauthorized, fmt.Errorf("room does not belong to the public key")
 		}
+
+		ok, err := auth.VerifyRoomSignature(regNode.Room, regNode.RoomSignature, regNode.PublicKey)
+		if err != nil {
+			return "", http.StatusBadRequest, fmt.Errorf("Failed to verify room signature %w", err)
+		}
+		if !ok {
+			return "", http.StatusUnauthorized, fmt.Errorf("Failed to verify room signature")
+		}
+		return getNodeName(host), http.StatusOK, nil
 	}
 
-	return regAddr, nil
+	status, err := d.verifyRegistrationV2(regNode, action, host, now)
+	if err != nil {
+		return "", status, err
+	}
+
+	if nodeName := signedNodeName(regNode); nodeName != "" {
+		return nodeName, http.StatusOK, nil
+	}
+	return getNodeName(host), http.StatusOK, nil
 }
 
-func (d *ReqLogic) RegisterNodeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		fmt.Println("Method not allowed")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// registrationTime returns the time of a registration. The signed timestamp of v2 requests orders
+// the changes the same way on every replica, so a request replayed at another instance can not undo a newer one.
+func registrationTime(regNode utils.RegisteringNode) time.Time {
+	if regNode.Version >= 2 {
+		return time.Unix(regNode.Timestamp, 0)
+	}
+	return time.Now()
+}
+
+// signedNodeName returns the node name that a v2 registration names itself with, or "" if the
+// name is derived from the client IP.
+func signedNodeName(regNode utils.RegisteringNode) string {
+	switch {
+	case regNode.NodePublicKey != "":
+		// verified to be the name of the node key
+		return regNode.Node
+	case regNode.Node != "":
+		return utils.NodeNameFromID(regNode.Room, regNode.Node)
+	default:
+		return ""
+	}
+}
+
+func (d *ReqLogic) verifyRegistrationV2(regNode utils.RegisteringNode, action string, host string, now time.Time) (int, error) {
+	if regNode.Version != 2 {
+		return http.StatusBadRequest, fmt.Errorf("unknown version %d", regNode.Version)
+	}
+
+	if len(regNode.Node) > 128 {
+		return http.StatusBadRequest, fmt.Errorf("node must be at most 128 characters")
+	}
+
+	if len(regNode.Nonce) < 16 || len(regNode.Nonce) > 128 {
+		return http.StatusBadRequest, fmt.Errorf("nonce must be between 16 and 128 characters")
+	}
+
+	timestamp := time.Unix(regNode.Timestamp, 0)
+	if timestamp.Before(now.Add(-d.settings.MaxClockSkew)) || timestamp.After(now.Add(d.settings.MaxClockSkew)) {
+		return http.StatusBadRequest, fmt.Errorf("timestamp is too old or in the future")
+	}
+
+	if regNode.Expires != 0 && regNode.Expires <= now.Unix() {
+		return http.StatusBadRequest, fmt.Errorf("expires is in the past")
+	}
+
+	if status, err := verifyRegistrationSignatures(regNode, action); err != nil {
+		return status, err
+	}
+
+	// a request that was replayed from another beacon must not undo a newer gossiped record
+	if d.gossipable(regNode) {
+		d.mu.RLock()
+		mark, err := d.highWater(regNode.Room, signedNodeName(regNode), now)
+		d.mu.RUnlock()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if regNode.Timestamp*1000 < mark {
+			return http.StatusConflict, fmt.Errorf("node has a newer registration")
+		}
 	}
 
+	// only remember the nonce of valid requests, so nobody can burn nonces of others
+	err := d.nonces.Use(nonceOwner(host), regNode.Room+":"+regNode.Nonce, timestamp.Add(d.settings.MaxClockSkew), now)
+	if err != nil {
+		return http.StatusConflict, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// verifyRegistrationSignatures checks that the room belongs to the public key and verifies the room
+// signature and the optional node signature over the canonical payload of a v2 registration.
+func verifyRegistrationSignatures(regNode utils.RegisteringNode, action string) (int, error) {
+	// the room has to belong to the key, otherwise any key could write to any room
+	roomName, err := auth.RoomNameFromPublicKey(regNode.PublicKey)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if roomName != regNode.Room {
+		return http.StatusUnauthorized, fmt.Errorf("room does not belong to the public key")
+	}
+
+	payload, err := regNode.CanonicalPayload(action)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	ok, err := auth.VerifyPayloadSignature(payload, regNode.RoomSignature, regNode.PublicKey)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Failed to verify room signature %w", err)
+	}
+	if !ok {
+		return http.StatusUnauthorized, fmt.Errorf("Failed to verify room signature")
+	}
+
+	// a node key proves that the node owns its name, the name is also covered by the room signature
+	if regNode.NodePublicKey != "" {
+		nodeName, err := auth.NodeNameFromPublicKey(regNode.NodePublicKey)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		if nodeName != regNode.Node {
+			return http.StatusUnauthorized, fmt.Errorf("node does not belong to the node public key")
+		}
+
+		ok, err := auth.VerifyPayloadSignature(payload, regNode.NodeSignature, regNode.NodePublicKey)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("Failed to verify node signature %w", err)
+		}
+		if !ok {
+			return http.StatusUnauthorized, fmt.Errorf("Failed to verify node signature")
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// readRegistration parses and verifies the body of a registration or deregistration at now and returns it
+// with the node name and the client IP. On failure it answers the request and returns false.
+func (d *ReqLogic) readRegistration(w http.ResponseWriter, r *http.Request, action string, now time.Time) (utils.RegisteringNode, string, string, bool) {
 	fmt.Println("Request received", r.Method, r.URL.Path)
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		fmt.Println("Failed to read body", err)
 		http.Error(w, "Failed to read body", http.StatusBadRequest)
-		return
+		return utils.RegisteringNode{}, "", "", false
 	}
 
-	regNode, err := validateAndParseRegisteringAddress(string(body))
+	// only registrations need addresses
+	parse := parseRegisteringNode
+	if action == utils.ActionRegister {
+		parse = validateAndParseRegisteringAddress
+	}
+	regNode, err := parse(string(body))
 	if err != nil {
 		fmt.Println("Failed to parse body", err)
 		http.Error(w, fmt.Errorf("Failed to parse body: %s ", err).Error(), http.StatusBadRequest)
-		return
+		return utils.RegisteringNode{}, "", "", false
 	}
 
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	host, err := getClientHost(r)
 	if err != nil {
-		fmt.Println("Failed to split host port", err)
-		http.Error(w, "Failed to split host port", http.StatusInternalServerError)
-		return
-	}
-	parsedAddr := net.ParseIP(host)
-	if parsedAddr == nil {
-		fmt.Println("Failed to parse IP", err)
-		http.Error(w, "Failed to parse IP", http.StatusInternalServerError)
-		return
+		fmt.Println("Failed to get client host", err)
+		http.Error(w, "Failed to get client host", http.StatusInternalServerError)
+		return utils.RegisteringNode{}, "", "", false
 	}
 
-	isPrivate := parsedAddr.IsPrivate()
-
-	// if host is from docker container, get the real ip via X-Real-Ip header
-	if isPrivate {
-		if r.Header.Get("X-Forwarded-Host") != "" {
-			host = r.Header.Get("X-Forwarded-Host")
-		}
-		if r.Header.Get("X-Forwarded-For") != "" {
-			host = r.Header.Get("X-Forwarded-For")
-		}
-		if r.Header.Get("X-Real-Ip") != "" {
-			host = r.Header.Get("X-Real-Ip")
-		}
-		if r.Header.Get("X-Real-IP") != "" {
-			host = r.Header.Get("X-Real-IP")
+	// limit before verifying, the signatures are the expensive part
+	if d.settings.RegisterLimits != nil {
+		_, _, _, ok, err := d.settings.RegisterLimits.Take(r.Context(), host)
+		if err != nil || !ok {
+			http.Error(w, "Too many registrations, try again later", http.StatusTooManyRequests)
+			return utils.RegisteringNode{}, "", "", false
 		}
 	}
 
 	// verify the roomName with the roomSignature
-	ok, err := auth.VerifyRoomSignature(regNode.Room, regNode.RoomSignature, regNode.PublicKey)
+	nodeName, status, err := d.verifyRegistration(regNode, action, host, now)
 	if err != nil {
-		http.Error(w, fmt.Errorf("Failed to verify room signature %w", err).Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), status)
+		return utils.RegisteringNode{}, "", "", false
+	}
+
+	return regNode, nodeName, host, true
+}
+
+func (d *ReqLogic) RegisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		d.DeregisterNodeHandler(w, r)
 		return
 	}
-	if !ok {
-		http.Error(w, "Failed to verify room signature", http.StatusUnauthorized)
+
+	if r.Method != http.MethodPost {
+		fmt.Println("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	nodeName := sha512.Sum512_224([]byte("node:" + host))
+	now := time.Now()
+	regNode, nodeName, host, ok := d.readRegistration(w, r, utils.ActionRegister, now)
+	if !ok {
+		return
+	}
 
+	// a signed expiry can only shorten the lifetime, a ttl of 0 would never expire
+	ttl := d.settings.RegistrationTTL
+	if regNode.Expires != 0 {
+		ttl = min(ttl, int(regNode.Expires-now.Unix()))
+		if ttl <= 0 {
+			http.Error(w, "expires is in the past", http.StatusBadRequest)
+			return
+		}
+	}
 	// set ttl to infinite if it is the demo room
-	ttl := 3600
-	if d.demoRoomName == regNode.Room {
+	if d.settings.DemoRoomName == regNode.Room {
 		ttl = 0
 	}
 
-	err = d.AddValue("room:"+regNode.Room, hex.EncodeToString(nodeName[:]), ttl)
+	addresses := make([]string, 0, len(regNode.Addresses))
+	for _, addr := range regNode.Addresses {
+		addresses = append(addresses, utils.FormatAddress(addr))
+	}
+
+	err := d.RegisterNode(regNode.Room, nodeName, addresses, ttl, registrationTime(regNode))
 	if err != nil {
 		fmt.Println("Failed to add value", err)
 		http.Error(w, "Failed to add value", http.StatusInternalServerError)
 		return
 	}
 
+	d.publishRecord(utils.ActionRegister, regNode)
+
+	fmt.Println("Node registered", nodeName, "from IP", host)
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeregisterNodeHandler removes the calling node, or only the given addresses of it, from the room.
+// The request body is the same as for the registration, the addresses are optional.
+func (d *ReqLogic) DeregisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		fmt.Println("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	regNode, nodeName, host, ok := d.readRegistration(w, r, utils.ActionDeregister, time.Now())
+	if !ok {
+		return
+	}
+
+	addresses := make([]string, 0, len(regNode.Addresses))
 	for _, addr := range regNode.Addresses {
-		err = d.AddValue("node:"+hex.EncodeToString(nodeName[:]), fmt.Sprintf("%s://%s:%d", addr.Protocol, addr.Ip, addr.Port), ttl)
-		if err != nil {
-			fmt.Println("Failed to add value", err)
-			http.Error(w, "Failed to add value", http.StatusInternalServerError)
-			return
-		}
+		addresses = append(addresses, utils.FormatAddress(addr))
 	}
 
-	fmt.Println("Node registered", hex.EncodeToString(nodeName[:]), "from IP", host)
+	err := d.DeregisterNode(regNode.Room, nodeName, addresses, registrationTime(regNode))
+	if err != nil {
+		fmt.Println("Failed to remove values", err)
+		http.Error(w, "Failed to remove values", http.StatusInternalServerError)
+		return
+	}
+
+	d.publishRecord(utils.ActionDeregister, regNode)
+
+	fmt.Println("Node deregistered", nodeName, "from IP", host)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -0,0 +1,94 @@
+package reqLogic
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetClientHost(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		forwarded  []string
+		want       string
+	}{
+		{
+			name:       "public client without proxy",
+			remoteAddr: "203.0.113.7:1234",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "headers of a public client are ignored",
+			remoteAddr: "203.0.113.7:1234",
+			realIP:     "198.51.100.1",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "real ip of a private proxy",
+			remoteAddr: "10.0.0.2:1234",
+			realIP:     "203.0.113.7",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "invalid real ip falls back to forwarded for",
+			remoteAddr: "10.0.0.2:1234",
+			realIP:     "client",
+			forwarded:  []string{"203.0.113.7"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "rightmost public hop",
+			remoteAddr: "10.0.0.2:1234",
+			forwarded:  []string{"198.51.100.1, 203.0.113.7, 10.0.0.3"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "hops in several headers",
+			remoteAddr: "10.0.0.2:1234",
+			forwarded:  []string{"198.51.100.1", "203.0.113.7, 10.0.0.3"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "only private hops",
+			remoteAddr: "10.0.0.2:1234",
+			forwarded:  []string{"192.168.1.5, 10.0.0.3"},
+			want:       "192.168.1.5",
+		},
+		{
+			name:       "invalid hop stops the search",
+			remoteAddr: "10.0.0.2:1234",
+			forwarded:  []string{"203.0.113.7, client, 10.0.0.3"},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "invalid headers fall back to the proxy",
+			remoteAddr: "10.0.0.2:1234",
+			forwarded:  []string{"client"},
+			want:       "10.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/register", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			for _, header := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+
+			got, err := getClientHost(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("getClientHost = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package reqLogic
+
+import (
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// nodeAddress is a parsed address of a node with the cache entry it was stored in.
+type nodeAddress struct {
+	Address utils.RegisteringAddress
+	Entry   cache.Entry
+}
+
+// getRoomNodes returns the membership entries of a room, the value of each entry is a node name.
+func (d *ReqLogic) getRoomNodes(room string) []cache.Entry {
+	entries, err := d.GetEntries("room:" + room)
+	if err != nil {
+		return nil
+	}
+	return entries
+}
+
+// getNodeAddresses returns the parsed addresses of a node.
+func (d *ReqLogic) getNodeAddresses(node string) []nodeAddress {
+	entries, err := d.GetEntries("node:" + node)
+	if err != nil {
+		return nil
+	}
+
+	addresses := make([]nodeAddress, 0, len(entries))
+	for _, entry := range entries {
+		addr, err := utils.ParseAddress(entry.Value)
+		if err != nil {
+			d.logger.Error("Failed to parse stored address", zap.String("node", node), zap.Error(err))
+			continue
+		}
+		addresses = append(addresses, nodeAddress{Address: addr, Entry: entry})
+	}
+	return addresses
+}
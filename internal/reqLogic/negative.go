@@ -0,0 +1,93 @@
+package reqLogic
+
+import (
+	"strings"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"github.com/miekg/dns"
+)
+
+// negativeResponse turns an empty answer into a NXDOMAIN or NODATA response with the SOA of
+// the zone in the authority section, so resolvers can cache it (RFC 2308).
+func (d *ReqLogic) negativeResponse(msg *dns.Msg, q dns.Question, z *zone.Zone) {
+	if len(msg.Answer) > 0 || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return
+	}
+
+	if d.nameExists(q.Name, z) {
+		msg.Rcode = dns.RcodeSuccess
+	} else {
+		msg.Rcode = dns.RcodeNameError
+	}
+
+	soa := d.newSOA(z)
+	// the TTL of the SOA is the negative TTL (RFC 2308 3)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	msg.Ns = append(msg.Ns, soa)
+}
+
+// nameExists reports whether qName has records or names below it, empty non-terminals
+// like room.<zone> exist as well.
+func (d *ReqLogic) nameExists(qName string, z *zone.Zone) bool {
+	qName = utils.ToLowerCase(qName)
+	name := z.Parse(qName)
+
+	switch name.Kind {
+	case zone.NameApex, zone.NameAuth:
+		return true
+
+	case zone.NameRoom:
+		if !utils.CheckIfSha224(name.ID) {
+			return false
+		}
+		return d.roomNameExists(name)
+
+	case zone.NameNode:
+		if !utils.CheckIfSha224(name.ID) || len(name.Labels) > 0 {
+			return false
+		}
+		return len(d.getNodeAddresses(name.ID)) > 0
+
+	default:
+		switch qName {
+		case z.RoomSuffix, z.NodeSuffix, z.AuthSuffix:
+			return true
+		}
+		return z.Records().Exists(qName)
+	}
+}
+
+// roomNameExists checks the room itself and the SRV and DNS-SD names below it.
+func (d *ReqLogic) roomNameExists(name zone.Name) bool {
+	if len(d.getRoomNodes(name.ID)) == 0 {
+		return false
+	}
+
+	labels := strings.Join(name.Labels, ".")
+	switch {
+	case len(name.Labels) == 0:
+		return true
+
+	case labels == "b._dns-sd._udp" || labels == "lb._dns-sd._udp" || labels == "_services._dns-sd._udp",
+		labels == "_dns-sd._udp" || labels == "_udp":
+		// DNS-SD browsing names and the empty non-terminals above them
+		return true
+
+	case len(name.Labels) <= 2 && dnssdProtocols[name.Labels[len(name.Labels)-1]] != "":
+		// _tcp, _udp and _service._tcp, _service._udp
+		protocol := dnssdProtocols[name.Labels[len(name.Labels)-1]]
+		return len(d.dnssdInstances(name.ID, protocol)) > 0
+
+	case len(name.Labels) == 3:
+		node, protocol, ok := dnssdInstanceName(name)
+		if !ok {
+			return false
+		}
+		_, found := d.findDNSSDInstance(name.ID, node, protocol)
+		return found
+
+	default:
+		return false
+	}
+}
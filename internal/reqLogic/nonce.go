@@ -0,0 +1,96 @@
+package reqLogic
+
+import (
+	"container/heap"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// nonceCache remembers used registration nonces until their timestamp left the allowed window.
+// Nonces outside the window can not be replayed anymore and are evicted first. It is bounded,
+// if it is full of nonces that are still inside the window new nonces are rejected
+// instead of forgetting valid ones, so a replay is never accepted.
+// Every owner, e.g. a client network, may only hold perOwner of the nonces, so a single sender can
+// not fill the cache and lock out everyone else.
+type nonceCache struct {
+	mu       sync.Mutex
+	size     int
+	perOwner int
+	nonces   map[string]nonceExpiry
+	owners   map[string]int // number of nonces per owner
+	byTime   nonceHeap
+}
+
+type nonceExpiry struct {
+	nonce   string
+	owner   string
+	expires int64
+}
+
+// nonceHeap orders the nonces by expiry, the next one to expire first.
+type nonceHeap []nonceExpiry
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].expires < h[j].expires }
+func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x any)        { *h = append(*h, x.(nonceExpiry)) }
+func (h *nonceHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+func newNonceCache(size int, perOwner int) *nonceCache {
+	return &nonceCache{
+		size:     size,
+		perOwner: perOwner,
+		nonces:   make(map[string]nonceExpiry, size),
+		owners:   make(map[string]int),
+	}
+}
+
+// nonceOwner returns the owner of the nonces of a client IP. IPv6 clients usually get a whole /64,
+// so it is one owner.
+func nonceOwner(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// Use marks nonce of owner as used until expires and fails if it was used before.
+func (n *nonceCache) Use(owner string, nonce string, expires time.Time, now time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// evict every nonce that left the window, they can not be replayed anymore
+	for n.byTime.Len() > 0 && n.byTime[0].expires <= now.Unix() {
+		oldest := heap.Pop(&n.byTime).(nonceExpiry)
+		// the nonce may have been used again with a later expiry
+		if n.nonces[oldest.nonce] != oldest {
+			continue
+		}
+		delete(n.nonces, oldest.nonce)
+		if n.owners[oldest.owner]--; n.owners[oldest.owner] <= 0 {
+			delete(n.owners, oldest.owner)
+		}
+	}
+
+	if _, ok := n.nonces[nonce]; ok {
+		return fmt.Errorf("nonce was already used")
+	}
+
+	if len(n.nonces) >= n.size || n.owners[owner] >= n.perOwner {
+		return fmt.Errorf("too many registrations, try again later")
+	}
+
+	entry := nonceExpiry{nonce: nonce, owner: owner, expires: expires.Unix()}
+	n.nonces[nonce] = entry
+	n.owners[owner]++
+	heap.Push(&n.byTime, entry)
+	return nil
+}
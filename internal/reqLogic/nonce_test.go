@@ -0,0 +1,143 @@
+package reqLogic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNonceCacheUse(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	type use struct {
+		owner   string
+		nonce   string
+		expires time.Duration // after now
+		at      time.Duration // after now
+		wantErr bool
+	}
+
+	tests := []struct {
+		name     string
+		size     int
+		perOwner int
+		uses     []use
+	}{
+		{
+			name: "new nonces are accepted",
+			size: 10,
+			uses: []use{
+				{nonce: "a", expires: time.Minute},
+				{nonce: "b", expires: time.Minute},
+			},
+		},
+		{
+			name: "replay inside the window is rejected",
+			size: 10,
+			uses: []use{
+				{nonce: "a", expires: time.Minute},
+				{nonce: "a", expires: time.Minute, at: 30 * time.Second, wantErr: true},
+			},
+		},
+		{
+			name: "nonce can be used again after it left the window",
+			size: 10,
+			uses: []use{
+				{nonce: "a", expires: time.Minute},
+				{nonce: "a", expires: 3 * time.Minute, at: 2 * time.Minute},
+				{nonce: "a", expires: 3 * time.Minute, at: 2 * time.Minute, wantErr: true},
+			},
+		},
+		{
+			name: "full cache rejects new nonces inside the window",
+			size: 2,
+			uses: []use{
+				{nonce: "a", expires: time.Minute},
+				{nonce: "b", expires: time.Minute},
+				{nonce: "c", expires: time.Minute, wantErr: true},
+			},
+		},
+		{
+			name: "full cache evicts nonces that left the window",
+			size: 2,
+			uses: []use{
+				{nonce: "a", expires: time.Minute},
+				{nonce: "b", expires: 5 * time.Minute},
+				{nonce: "c", expires: 5 * time.Minute, at: 2 * time.Minute},
+				{nonce: "b", expires: 5 * time.Minute, at: 2 * time.Minute, wantErr: true},
+			},
+		},
+		{
+			name:     "one owner can not fill the cache",
+			size:     10,
+			perOwner: 2,
+			uses: []use{
+				{owner: "192.0.2.1", nonce: "a", expires: time.Minute},
+				{owner: "192.0.2.1", nonce: "b", expires: time.Minute},
+				{owner: "192.0.2.1", nonce: "c", expires: time.Minute, wantErr: true},
+				{owner: "192.0.2.2", nonce: "d", expires: time.Minute},
+			},
+		},
+		{
+			name:     "owner gets room again after its nonces left the window",
+			size:     10,
+			perOwner: 1,
+			uses: []use{
+				{owner: "192.0.2.1", nonce: "a", expires: time.Minute},
+				{owner: "192.0.2.1", nonce: "b", expires: 3 * time.Minute, wantErr: true},
+				{owner: "192.0.2.1", nonce: "b", expires: 3 * time.Minute, at: 2 * time.Minute},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perOwner := tt.perOwner
+			if perOwner == 0 {
+				perOwner = tt.size
+			}
+			cache := newNonceCache(tt.size, perOwner)
+			for i, u := range tt.uses {
+				err := cache.Use(u.owner, u.nonce, now.Add(u.expires), now.Add(u.at))
+				if (err != nil) != u.wantErr {
+					t.Fatalf("use %d of %q: err = %v, want error %v", i, u.nonce, err, u.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestNonceCacheStaysBounded(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newNonceCache(100, 100)
+
+	// every nonce leaves the window a second after it was used
+	for i := 0; i < 1000; i++ {
+		at := now.Add(time.Duration(i) * time.Second)
+		if err := cache.Use("192.0.2.1", fmt.Sprintf("nonce-%d", i), at.Add(time.Second), at); err != nil {
+			t.Fatalf("use %d: %v", i, err)
+		}
+	}
+
+	if len(cache.nonces) > 2 || cache.byTime.Len() > 2 || cache.owners["192.0.2.1"] > 2 {
+		t.Fatalf("cache holds %d nonces and %d expiries, want the expired ones evicted", len(cache.nonces), cache.byTime.Len())
+	}
+}
+
+func TestNonceOwner(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "192.0.2.1", want: "192.0.2.1"},
+		{host: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::"},
+		{host: "2001:db8:1:2::7", want: "2001:db8:1:2::"},
+		{host: "invalid", want: "invalid"},
+	}
+
+	for _, tt := range tests {
+		if got := nonceOwner(tt.host); got != tt.want {
+			t.Errorf("nonceOwner(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package reqLogic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Requests between beacons are signed with a shared secret: an HMAC-SHA256 over the method, path,
+// timestamp, a random nonce and the body. A signed request is only accepted once inside the clock skew window.
+const (
+	peerTimestampHeader = "X-Pathfinder-Timestamp"
+	peerNonceHeader     = "X-Pathfinder-Nonce"
+	peerSignatureHeader = "X-Pathfinder-Signature"
+)
+
+func peerSignature(secret []byte, method string, path string, timestamp string, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// peerResponseSignature is the HMAC over the answer to the request with nonce, so it can not be
+// replaced on the way or replayed as the answer to another request.
+func peerResponseSignature(secret []byte, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("response\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// writePeerResponse answers the verified request r of a peer with body signed by secret.
+func writePeerResponse(w http.ResponseWriter, r *http.Request, secret []byte, body []byte) {
+	w.Header().Set(peerSignatureHeader, peerResponseSignature(secret, r.Header.Get(peerNonceHeader), body))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// readPeerResponse reads the answer of a peer to a request with nonce and checks its signature.
+func readPeerResponse(resp *http.Response, secret []byte, nonce string) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read body: %v", err)
+	}
+
+	expected := peerResponseSignature(secret, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(resp.Header.Get(peerSignatureHeader))) {
+		return nil, fmt.Errorf("Invalid signature of the response")
+	}
+	return body, nil
+}
+
+// signPeerRequest adds the timestamp, nonce and signature headers to req.
+func signPeerRequest(req *http.Request, secret []byte, body []byte) error {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(random)
+	req.Header.Set(peerTimestampHeader, timestamp)
+	req.Header.Set(peerNonceHeader, nonce)
+	req.Header.Set(peerSignatureHeader, peerSignature(secret, req.Method, req.URL.Path, timestamp, nonce, body))
+	return nil
+}
+
+// maxPeerBody is the largest body of a request between beacons, a batch of signed records is a few MiB.
+const maxPeerBody = 16 << 20
+
+// verifyPeerRequest checks the signature of r against every secret and returns the index of the
+// matching secret and the body. The nonce is remembered in nonces until the timestamp leaves the window.
+// The headers are checked before the body is read, so unsigned requests can not make the beacon buffer it.
+func verifyPeerRequest(w http.ResponseWriter, r *http.Request, secrets [][]byte, nonces *nonceCache, maxSkew time.Duration) (int, []byte, error) {
+	timestamp := r.Header.Get(peerTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return -1, nil, fmt.Errorf("Invalid timestamp")
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return -1, nil, fmt.Errorf("timestamp is too old or in the future")
+	}
+
+	nonce := r.Header.Get(peerNonceHeader)
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return -1, nil, fmt.Errorf("Invalid nonce")
+	}
+
+	signature := []byte(r.Header.Get(peerSignatureHeader))
+	if len(signature) != hex.EncodedLen(sha256.Size) {
+		return -1, nil, fmt.Errorf("Invalid signature")
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPeerBody))
+	if err != nil {
+		return -1, nil, fmt.Errorf("Failed to read body: %v", err)
+	}
+
+	for i, secret := range secrets {
+		expected := peerSignature(secret, r.Method, r.URL.Path, timestamp, nonce, body)
+		if !hmac.Equal([]byte(expected), signature) {
+			continue
+		}
+
+		if err := nonces.Use("", nonce, time.Unix(unix, 0).Add(maxSkew), now); err != nil {
+			return -1, nil, err
+		}
+		return i, body, nil
+	}
+	return -1, nil, fmt.Errorf("Invalid signature")
+}
@@ -0,0 +1,168 @@
+package reqLogic
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// countingReader counts the bytes read from the body.
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestVerifyPeerRequest(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	other := []byte("fedcba9876543210fedcba9876543210")
+	body := []byte(`{"records":[]}`)
+
+	tests := []struct {
+		name     string
+		secret   []byte
+		edit     func(r *http.Request)
+		wantErr  bool
+		wantRead bool // whether the body may be read
+		want     int  // index of the secret
+	}{
+		{name: "valid request", secret: secret, wantRead: true},
+		{name: "second secret", secret: other, wantRead: true, want: 1},
+		{
+			name:    "missing timestamp",
+			secret:  secret,
+			edit:    func(r *http.Request) { r.Header.Del(peerTimestampHeader) },
+			wantErr: true,
+		},
+		{
+			name:   "old timestamp",
+			secret: secret,
+			edit: func(r *http.Request) {
+				r.Header.Set(peerTimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+			},
+			wantErr: true,
+		},
+		{
+			name:    "short nonce",
+			secret:  secret,
+			edit:    func(r *http.Request) { r.Header.Set(peerNonceHeader, "abc") },
+			wantErr: true,
+		},
+		{
+			name:    "missing signature",
+			secret:  secret,
+			edit:    func(r *http.Request) { r.Header.Del(peerSignatureHeader) },
+			wantErr: true,
+		},
+		{
+			name:     "unknown secret",
+			secret:   []byte("not-a-secret-of-any-peer-0123456"),
+			wantErr:  true,
+			wantRead: true,
+		},
+		{
+			name:     "changed path",
+			secret:   secret,
+			edit:     func(r *http.Request) { r.URL.Path = replicationStatePath },
+			wantErr:  true,
+			wantRead: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, federationRecordsPath, nil)
+			if err := signPeerRequest(r, tt.secret, body); err != nil {
+				t.Fatal(err)
+			}
+			if tt.edit != nil {
+				tt.edit(r)
+			}
+			reader := &countingReader{Reader: bytes.NewReader(body)}
+			r.Body = io.NopCloser(reader)
+
+			nonces := newNonceCache(10, 10)
+			i, got, err := verifyPeerRequest(httptest.NewRecorder(), r, [][]byte{secret, other}, nonces, time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if reader.read > 0 && !tt.wantRead {
+				t.Errorf("body was read before the headers were checked")
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("body = %q, want %q", got, body)
+			}
+			if i != tt.want {
+				t.Errorf("secret index = %d, want %d", i, tt.want)
+			}
+
+			// the same request is only accepted once
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if _, _, err := verifyPeerRequest(httptest.NewRecorder(), r, [][]byte{secret, other}, nonces, time.Minute); err == nil {
+				t.Errorf("replayed request was accepted")
+			}
+		})
+	}
+}
+
+func TestReadPeerResponse(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	body := []byte(`{"keys":[]}`)
+
+	tests := []struct {
+		name    string
+		edit    func(resp *http.Response)
+		nonce   string
+		wantErr bool
+	}{
+		{name: "valid response", nonce: "nonce-of-request"},
+		{name: "answer to another request", nonce: "nonce-of-other-request", wantErr: true},
+		{
+			name:  "changed body",
+			nonce: "nonce-of-request",
+			edit: func(resp *http.Response) {
+				resp.Body = io.NopCloser(bytes.NewReader([]byte(`{"keys":[{"key":"room:x"}]}`)))
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unsigned response",
+			nonce:   "nonce-of-request",
+			edit:    func(resp *http.Response) { resp.Header.Del(peerSignatureHeader) },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, replicationStatePath, nil)
+			r.Header.Set(peerNonceHeader, "nonce-of-request")
+			w := httptest.NewRecorder()
+			writePeerResponse(w, r, secret, body)
+
+			resp := w.Result()
+			if tt.edit != nil {
+				tt.edit(resp)
+			}
+			got, err := readPeerResponse(resp, secret, tt.nonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, body) {
+				t.Errorf("body = %q, want %q", got, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package reqLogic
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	maxRawUpdates     = 1000
+	rawUpdateLifetime = 10 * time.Second
+)
+
+// rawUpdates keeps the wire format of received updates until they are handled. SIG(0) signs the
+// message as it was sent, but the DNS server only passes the unpacked message to the handler.
+// An update is found by the address of its sender and its message ID. Updates are only read over
+// TCP, so the senders can not be spoofed.
+type rawUpdates struct {
+	mu       sync.Mutex
+	messages map[string]rawUpdate
+}
+
+type rawUpdate struct {
+	raw      []byte
+	received time.Time
+}
+
+func newRawUpdates() *rawUpdates {
+	return &rawUpdates{messages: make(map[string]rawUpdate)}
+}
+
+func rawUpdateKey(remote net.Addr, id uint16) string {
+	return fmt.Sprintf("%s/%d", remote.String(), id)
+}
+
+// add remembers raw if it is an update, other messages are ignored.
+func (u *rawUpdates) add(remote net.Addr, raw []byte) {
+	if remote == nil || len(raw) < 12 || int(raw[2]>>3)&0xF != dns.OpcodeUpdate {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// updates that were rejected before they were handled are not taken
+	now := time.Now()
+	for key, update := range u.messages {
+		if now.Sub(update.received) > rawUpdateLifetime {
+			delete(u.messages, key)
+		}
+	}
+	// the oldest update makes room, a full buffer must not block new updates
+	if len(u.messages) >= maxRawUpdates {
+		oldest := ""
+		for key, update := range u.messages {
+			if oldest == "" || update.received.Before(u.messages[oldest].received) {
+				oldest = key
+			}
+		}
+		delete(u.messages, oldest)
+	}
+
+	// the server reuses the read buffers
+	id := uint16(raw[0])<<8 | uint16(raw[1])
+	u.messages[rawUpdateKey(remote, id)] = rawUpdate{raw: slices.Clone(raw), received: now}
+}
+
+// take returns and forgets the wire format of the update with id from remote, nil if it is unknown.
+func (u *rawUpdates) take(remote net.Addr, id uint16) []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := rawUpdateKey(remote, id)
+	update, ok := u.messages[key]
+	if !ok {
+		return nil
+	}
+	delete(u.messages, key)
+	return update.raw
+}
+
+// updateReader is a dns.Reader that remembers the wire format of updates, see DecorateReader.
+type updateReader struct {
+	dns.Reader
+	updates *rawUpdates
+}
+
+// DecorateReader is the dns.DecorateReader of the TCP DNS servers, it is needed to verify SIG(0) signatures.
+func (d *ReqLogic) DecorateReader(reader dns.Reader) dns.Reader {
+	return &updateReader{Reader: reader, updates: d.rawUpdates}
+}
+
+func (r *updateReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	raw, err := r.Reader.ReadTCP(conn, timeout)
+	if err == nil {
+		r.updates.add(conn.RemoteAddr(), raw)
+	}
+	return raw, err
+}
@@ -0,0 +1,157 @@
+package reqLogic
+
+import (
+	"slices"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+)
+
+// RegisterNode adds node to room and adds or refreshes its addresses, a ttl of 0 means forever.
+// updated is the time of the registration, see AddValue.
+// Watchers of the room are told about joining nodes and changed addresses.
+func (d *ReqLogic) RegisterNode(room string, node string, addresses []string, ttl int, updated time.Time) error {
+	// the room and the addresses are written at once, the event is decided under the same lock,
+	// so concurrent registrations of a node can not both join
+	var joined, changed bool
+	var after []string
+	err := d.update(func(now time.Time) error {
+		members, err := d.loadEntries("room:"+room, now)
+		if err != nil {
+			return err
+		}
+		before, err := d.loadEntries("node:"+node, now)
+		if err != nil {
+			return err
+		}
+
+		if err := d.addValue("room:"+room, node, ttl, updated, now); err != nil {
+			return err
+		}
+		for _, addr := range addresses {
+			if err := d.addValue("node:"+node, addr, ttl, updated, now); err != nil {
+				return err
+			}
+		}
+
+		entries, err := d.loadEntries("node:"+node, now)
+		if err != nil {
+			return err
+		}
+		after = entryValues(entries)
+		joined = !slices.Contains(entryValues(members), node)
+		changed = !sameValues(entryValues(before), after)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case joined:
+		d.watch.publish(room, EventJoin, node, after)
+	case changed:
+		d.watch.publish(room, EventAddressChange, node, after)
+	}
+
+	return nil
+}
+
+// DeregisterNode removes the given addresses of node, or the whole node from room if none are given.
+// Addresses that were registered after updated are kept.
+// The node leaves the room if it has no addresses left. The addresses of a node that left are only removed
+// if no other room lists it, a node named after its IP can be a member of several rooms.
+func (d *ReqLogic) DeregisterNode(room string, node string, addresses []string, updated time.Time) error {
+	var member, nodeGone bool
+	var after []string
+	err := d.update(func(now time.Time) error {
+		members, err := d.loadEntries("room:"+room, now)
+		if err != nil {
+			return err
+		}
+		member = slices.Contains(entryValues(members), node)
+
+		// the addresses that are left, for the event
+		defer func() {
+			if entries, err := d.loadEntries("node:"+node, now); err == nil {
+				after = entryValues(entries)
+			}
+		}()
+
+		if len(addresses) > 0 {
+			nodeGone, err = d.removeValues("node:"+node, addresses, updated, now)
+			if err != nil || !nodeGone {
+				return err
+			}
+			_, err = d.removeValues("room:"+room, []string{node}, updated, now)
+			return err
+		}
+
+		if _, err := d.removeValues("room:"+room, []string{node}, updated, now); err != nil {
+			return err
+		}
+		entries, err := d.loadEntries("room:"+room, now)
+		if err != nil || slices.Contains(entryValues(entries), node) {
+			// registered again after updated
+			return err
+		}
+		nodeGone = true
+
+		if d.listedInOtherRoom(node, room, now) {
+			return nil
+		}
+		entries, err = d.loadEntries("node:"+node, now)
+		if err != nil {
+			return err
+		}
+		_, err = d.removeValues("node:"+node, entryValues(entries), updated, now)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !nodeGone {
+		d.watch.publish(room, EventAddressChange, node, after)
+		return nil
+	}
+
+	if member {
+		d.watch.publish(room, EventLeave, node, nil)
+	}
+	return nil
+}
+
+// listedInOtherRoom reports whether a room other than room lists node. The caller must hold the lock.
+func (d *ReqLogic) listedInOtherRoom(node string, room string, now time.Time) bool {
+	found := false
+	d.store.Iterate("room:", func(key string, value []byte) bool {
+		if key == "room:"+room {
+			return true
+		}
+		entries, err := cache.DecodeEntries(value)
+		if err != nil {
+			return true
+		}
+		for _, entry := range entries {
+			if entry.Value == node && !entry.Expired(now) {
+				found = true
+				return false
+			}
+		}
+		return true
+	})
+	return found
+}
+
+func sameValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = slices.Clone(a)
+	b = slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
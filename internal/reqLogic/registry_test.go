@@ -0,0 +1,135 @@
+package reqLogic
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"go.uber.org/zap"
+)
+
+func newRegistryTestLogic() *ReqLogic {
+	return &ReqLogic{
+		store:    cache.NewMemoryStore(),
+		logger:   zap.NewNop(),
+		watch:    newWatchHub(100),
+		settings: Settings{RegistrationTTL: 3600},
+	}
+}
+
+func TestDeregisterNode(t *testing.T) {
+	now := time.Now()
+	a := "tcp://192.0.2.1:80"
+	b := "udp://192.0.2.1:53"
+
+	type registration struct {
+		room      string
+		addresses []string
+	}
+
+	tests := []struct {
+		name          string
+		registrations []registration
+		room          string
+		addresses     []string // removed, all if empty
+		wantAddresses []string
+		wantRooms     map[string]bool // whether the room still lists the node
+		wantEvent     string
+	}{
+		{
+			name:          "some addresses",
+			registrations: []registration{{"room-a", []string{a, b}}},
+			room:          "room-a",
+			addresses:     []string{a},
+			wantAddresses: []string{b},
+			wantRooms:     map[string]bool{"room-a": true},
+			wantEvent:     EventAddressChange,
+		},
+		{
+			name:          "last address",
+			registrations: []registration{{"room-a", []string{a}}},
+			room:          "room-a",
+			addresses:     []string{a},
+			wantRooms:     map[string]bool{"room-a": false},
+			wantEvent:     EventLeave,
+		},
+		{
+			name:          "whole node",
+			registrations: []registration{{"room-a", []string{a, b}}},
+			room:          "room-a",
+			wantRooms:     map[string]bool{"room-a": false},
+			wantEvent:     EventLeave,
+		},
+		{
+			name:          "whole node keeps its addresses for other rooms",
+			registrations: []registration{{"room-a", []string{a}}, {"room-b", []string{b}}},
+			room:          "room-a",
+			wantAddresses: []string{a, b},
+			wantRooms:     map[string]bool{"room-a": false, "room-b": true},
+			wantEvent:     EventLeave,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newRegistryTestLogic()
+			for _, reg := range tt.registrations {
+				if err := d.RegisterNode(reg.room, "node-1", reg.addresses, 3600, now.Add(-time.Minute)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := d.DeregisterNode(tt.room, "node-1", tt.addresses, now); err != nil {
+				t.Fatal(err)
+			}
+
+			addresses, _ := d.GetValues("node:node-1")
+			if !sameValues(addresses, tt.wantAddresses) {
+				t.Errorf("addresses = %v, want %v", addresses, tt.wantAddresses)
+			}
+			for room, want := range tt.wantRooms {
+				members, _ := d.GetValues("room:" + room)
+				if got := slices.Contains(members, "node-1"); got != want {
+					t.Errorf("%s lists the node = %v, want %v", room, got, want)
+				}
+			}
+			if last := d.watch.history[len(d.watch.history)-1]; last.Type != tt.wantEvent || last.Room != tt.room {
+				t.Errorf("last event = %s in %s, want %s in %s", last.Type, last.Room, tt.wantEvent, tt.room)
+			}
+		})
+	}
+}
+
+func TestRegisterNodeJoinsOnce(t *testing.T) {
+	d := newRegistryTestLogic()
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addr := fmt.Sprintf("tcp://192.0.2.1:%d", 8000+i)
+			if err := d.RegisterNode("room-a", "node-1", []string{addr}, 3600, now); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	joins, changes := 0, 0
+	for _, event := range d.watch.history {
+		switch event.Type {
+		case EventJoin:
+			joins++
+		case EventAddressChange:
+			changes++
+		}
+	}
+	if joins != 1 || changes != 19 {
+		t.Errorf("got %d joins and %d address changes, want 1 and 19", joins, changes)
+	}
+}
@@ -0,0 +1,386 @@
+package reqLogic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"go.uber.org/zap"
+)
+
+const (
+	replicationPushPath  = "/v1/replication/push"
+	replicationStatePath = "/v1/replication/state"
+
+	// removed values are remembered at least this long, so stale peers can not bring them back
+	minTombstoneLifetime = time.Hour
+)
+
+// replicator sends the local changes to the peers and pulls their state for anti-entropy.
+type replicator struct {
+	peers  []string
+	secret []byte
+	client *http.Client
+	nonces *nonceCache // nonces of the received requests
+
+	mu    sync.Mutex
+	dirty map[string]struct{}
+}
+
+// replicatedKey is a key with its entries and the tombstones of removed values.
+type replicatedKey struct {
+	Key        string        `json:"key"`
+	Entries    []cache.Entry `json:"entries"`
+	Tombstones []cache.Entry `json:"tombstones,omitempty"`
+}
+
+type replicationBatch struct {
+	Keys []replicatedKey `json:"keys"`
+}
+
+func newReplicator(peers []string, secret []byte) *replicator {
+	return &replicator{
+		peers:  peers,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+		nonces: newNonceCache(100000, 100000),
+		dirty:  make(map[string]struct{}),
+	}
+}
+
+func (r *replicator) markDirty(key string) {
+	r.mu.Lock()
+	r.dirty[key] = struct{}{}
+	r.mu.Unlock()
+}
+
+func (r *replicator) takeDirty() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.dirty))
+	for key := range r.dirty {
+		keys = append(keys, key)
+	}
+	r.dirty = make(map[string]struct{})
+	return keys
+}
+
+func tombstoneKey(key string) string {
+	return "tomb:" + key
+}
+
+// addTombstones remembers removed entries of key for the peers, updated is the time of the removal.
+// The caller must hold the lock.
+func (d *ReqLogic) addTombstones(key string, removed []cache.Entry, now time.Time, updated time.Time) error {
+	if d.replication == nil || len(removed) == 0 {
+		return nil
+	}
+
+	tombstones, err := d.loadEntries(tombstoneKey(key), now)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range removed {
+		expires := entry.Expires
+		if expires == 0 || expires < now.Add(minTombstoneLifetime).Unix() {
+			expires = now.Add(minTombstoneLifetime).Unix()
+		}
+
+		tombstones = slices.DeleteFunc(tombstones, func(t cache.Entry) bool { return t.Value == entry.Value })
+		tombstones = append(tombstones, cache.Entry{Value: entry.Value, Expires: expires, Updated: updated.UnixMilli()})
+	}
+
+	d.replication.markDirty(key)
+	return d.saveEntries(tombstoneKey(key), tombstones, now)
+}
+
+// removedSince reports whether value was removed from key at or after updated. The caller must hold the lock.
+func (d *ReqLogic) removedSince(key string, value string, updated time.Time, now time.Time) (bool, error) {
+	tombstones, err := d.loadEntries(tombstoneKey(key), now)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range tombstones {
+		// like in cache.MergeReplicated a removal wins over a change at the same time
+		if t.Value == value && t.Updated >= updated.UnixMilli() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeTombstone forgets the removal of value after it was added again. The caller must hold the lock.
+func (d *ReqLogic) removeTombstone(key string, value string, now time.Time) error {
+	tombstones, err := d.loadEntries(tombstoneKey(key), now)
+	if err != nil || len(tombstones) == 0 {
+		return err
+	}
+
+	remaining := slices.DeleteFunc(tombstones, func(t cache.Entry) bool { return t.Value == value })
+	return d.saveEntries(tombstoneKey(key), remaining, now)
+}
+
+// replicatedKeys returns the entries and tombstones of keys, keys that can not be read are left out.
+func (d *ReqLogic) replicatedKeys(keys []string) []replicatedKey {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	now := time.Now()
+	result := make([]replicatedKey, 0, len(keys))
+	for _, key := range keys {
+		entries, err := d.loadEntries(key, now)
+		if err != nil {
+			continue
+		}
+		tombstones, err := d.loadEntries(tombstoneKey(key), now)
+		if err != nil {
+			continue
+		}
+		result = append(result, replicatedKey{Key: key, Entries: entries, Tombstones: tombstones})
+	}
+	return result
+}
+
+// mergeReplicatedKeys merges keys from a peer into the store and tells watchers about the changes.
+// It returns the number of changed keys.
+func (d *ReqLogic) mergeReplicatedKeys(keys []replicatedKey) int {
+	changed := 0
+	for _, remote := range keys {
+		if !strings.HasPrefix(remote.Key, "room:") && !strings.HasPrefix(remote.Key, "node:") {
+			continue
+		}
+
+		var entries, mergedEntries []cache.Entry
+		keyChanged := false
+		err := d.update(func(now time.Time) error {
+			var err error
+			entries, err = d.loadEntries(remote.Key, now)
+			if err != nil {
+				return err
+			}
+			tombstones, err := d.loadEntries(tombstoneKey(remote.Key), now)
+			if err != nil {
+				return err
+			}
+
+			var mergedTombstones []cache.Entry
+			mergedEntries, mergedTombstones, keyChanged = cache.MergeReplicated(entries, tombstones, remote.Entries, remote.Tombstones, now)
+			if !keyChanged {
+				return nil
+			}
+			if err := d.saveEntries(remote.Key, mergedEntries, now); err != nil {
+				return err
+			}
+			return d.saveEntries(tombstoneKey(remote.Key), mergedTombstones, now)
+		})
+		if err != nil {
+			d.logger.Error("Failed to merge replicated key", zap.String("key", remote.Key), zap.Error(err))
+			continue
+		}
+
+		if !keyChanged {
+			continue
+		}
+		changed++
+		d.ZonesChanged()
+
+		// tell watchers about the changes like for local registrations
+		switch {
+		case strings.HasPrefix(remote.Key, "room:"):
+			room := strings.TrimPrefix(remote.Key, "room:")
+			for _, node := range entryValues(mergedEntries) {
+				if !slices.Contains(entryValues(entries), node) {
+					addresses, _ := d.GetValues("node:" + node)
+					d.watch.publish(room, EventJoin, node, addresses)
+				}
+			}
+			for _, node := range entryValues(entries) {
+				if !slices.Contains(entryValues(mergedEntries), node) {
+					d.watch.publish(room, EventLeave, node, nil)
+				}
+			}
+		case strings.HasPrefix(remote.Key, "node:"):
+			d.watch.markNodeChanged(strings.TrimPrefix(remote.Key, "node:"))
+		}
+	}
+	return changed
+}
+
+func entryValues(entries []cache.Entry) []string {
+	values := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		values = append(values, entry.Value)
+	}
+	return values
+}
+
+// verifyReplicationRequest checks the signature, timestamp and nonce of a request of a peer and returns the body.
+func (d *ReqLogic) verifyReplicationRequest(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	_, body, err := verifyPeerRequest(w, r, [][]byte{d.replication.secret}, d.replication.nonces, d.settings.MaxClockSkew)
+	return body, err
+}
+
+// ReplicationPushHandler merges the changes that a peer sends.
+func (d *ReqLogic) ReplicationPushHandler(w http.ResponseWriter, r *http.Request) {
+	if d.replication == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := d.verifyReplicationRequest(w, r)
+	if err != nil {
+		d.logger.Warn("Rejected replication push", zap.String("remote", r.RemoteAddr), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var batch replicationBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	d.mergeReplicatedKeys(batch.Keys)
+	writePeerResponse(w, r, d.replication.secret, nil)
+}
+
+// ReplicationStateHandler returns all keys with their tombstones, peers merge it for anti-entropy.
+func (d *ReqLogic) ReplicationStateHandler(w http.ResponseWriter, r *http.Request) {
+	if d.replication == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if _, err := d.verifyReplicationRequest(w, r); err != nil {
+		d.logger.Warn("Rejected replication state request", zap.String("remote", r.RemoteAddr), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	d.mu.RLock()
+	keys := append(d.store.Keys("room:"), d.store.Keys("node:")...)
+	known := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		known[key] = struct{}{}
+	}
+	for _, key := range d.store.Keys("tomb:") {
+		// keys that only have tombstones left
+		key := strings.TrimPrefix(key, "tomb:")
+		if _, ok := known[key]; !ok {
+			known[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	d.mu.RUnlock()
+
+	body, err := json.Marshal(replicationBatch{Keys: d.replicatedKeys(keys)})
+	if err != nil {
+		d.logger.Error("Failed to encode replication state", zap.Error(err))
+		http.Error(w, "Failed to encode state", http.StatusInternalServerError)
+		return
+	}
+	writePeerResponse(w, r, d.replication.secret, body)
+}
+
+// replicationRequest sends a signed request to a peer and returns the body of the answer,
+// which is signed by the peer as well.
+func (d *ReqLogic) replicationRequest(ctx context.Context, method string, peer string, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(peer, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := signPeerRequest(req, d.replication.secret, body); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.replication.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer answered %s", resp.Status)
+	}
+	return readPeerResponse(resp, d.replication.secret, req.Header.Get(peerNonceHeader))
+}
+
+// pushChanges sends the keys that changed since the last push to all peers.
+// Failed pushes are not retried, the next anti-entropy pull of the peer gets them.
+func (d *ReqLogic) pushChanges() {
+	keys := d.replication.takeDirty()
+	if len(keys) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(replicationBatch{Keys: d.replicatedKeys(keys)})
+	if err != nil {
+		d.logger.Error("Failed to encode replication batch", zap.Error(err))
+		return
+	}
+
+	for _, peer := range d.replication.peers {
+		go func(peer string) {
+			if _, err := d.replicationRequest(context.Background(), http.MethodPost, peer, replicationPushPath, body); err != nil {
+				d.logger.Warn("Failed to push changes to peer", zap.String("peer", peer), zap.Error(err))
+			}
+		}(peer)
+	}
+}
+
+// pullState merges the whole state of peer.
+func (d *ReqLogic) pullState(peer string) {
+	body, err := d.replicationRequest(context.Background(), http.MethodGet, peer, replicationStatePath, nil)
+	if err != nil {
+		d.logger.Warn("Failed to pull state from peer", zap.String("peer", peer), zap.Error(err))
+		return
+	}
+
+	var batch replicationBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		d.logger.Warn("Failed to decode state of peer", zap.String("peer", peer), zap.Error(err))
+		return
+	}
+
+	if changed := d.mergeReplicatedKeys(batch.Keys); changed > 0 {
+		d.logger.Info("Merged state of peer", zap.String("peer", peer), zap.Int("changed_keys", changed))
+	}
+}
+
+// StartReplication pushes local changes to the peers every pushInterval and pulls
+// the state of every peer every pullInterval, starting right away to catch up after a restart.
+func (d *ReqLogic) StartReplication(pushInterval time.Duration, pullInterval time.Duration) {
+	if d.replication == nil {
+		return
+	}
+
+	push := time.NewTicker(pushInterval)
+	defer push.Stop()
+	pull := time.NewTicker(pullInterval)
+	defer pull.Stop()
+
+	for _, peer := range d.replication.peers {
+		d.pullState(peer)
+	}
+
+	for {
+		select {
+		case <-push.C:
+			d.pushChanges()
+		case <-pull.C:
+			for _, peer := range d.replication.peers {
+				d.pullState(peer)
+			}
+		}
+	}
+}
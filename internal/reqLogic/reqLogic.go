@@ -1,77 +1,175 @@
 package reqLogic
 
 import (
+	"crypto/tls"
 	"html/template"
 	"log"
-	"os"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"github.com/i5heu/PathfinderBeacon/pkg/dnssec"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
 	"github.com/miekg/dns"
 	"github.com/sethvargo/go-limiter"
 	"go.uber.org/zap"
 )
 
+// Settings are the tunables of the request logic that come from the server config.
+type Settings struct {
+	DemoRoomName    string
+	Zones           *zone.Zones
+	RoomTTL         uint32 // TTL of room TXT answers
+	NodeTTL         uint32 // TTL of node TXT answers
+	StaticTTL       uint32 // TTL of SOA, NS, A and AAAA answers
+	NegativeTTL     uint32 // TTL of NXDOMAIN and NODATA answers
+	RegistrationTTL int    // lifetime of a registered address in seconds
+
+	AllowV1Registration bool          // accept registrations that only sign the room name
+	MaxClockSkew        time.Duration // allowed age of v2 registration timestamps
+	NonceCacheSize      int           // max number of remembered v2 nonces
+	RegisterLimits      limiter.Store // registrations and deregistrations per client IP
+
+	Signers map[string]*dnssec.Signer // DNSSEC signers by zone apex, unsigned zones are missing
+
+	UDPSize        uint16        // EDNS0 UDP buffer size advertised to clients
+	CookieRotation time.Duration // interval in which the DNS cookie secret is replaced
+
+	UDPListsNeedCookie bool // TXT, SRV and PTR over UDP are only answered for clients with a valid server cookie
+
+	TransferAllowFrom []*net.IPNet      // networks that may transfer the zones with AXFR/IXFR
+	TSIGSecrets       map[string]string // TSIG key names and base64 secrets, transfers need a valid signature if set
+	Secondaries       []string          // host:port of secondaries that get a NOTIFY when the zones change
+	NotifyKey         string            // TSIG key that signs NOTIFY messages, unsigned if empty
+	NotifyAlgorithm   string            // TSIG algorithm of the notify key, e.g. hmac-sha256.
+	JournalSize       int               // number of zone changes kept for IXFR
+
+	ReplicationPeers  []string // base URLs of the other instances that share the rooms and nodes
+	ReplicationSecret []byte   // shared HMAC secret that authenticates the replication requests
+
+	FederationPeers       []string      // base URLs of trusted beacons of other operators that exchange signed records
+	FederationSecrets     [][]byte      // HMAC secret shared with every peer, in the order of FederationPeers
+	FederationMaxLifetime time.Duration // longest accepted time between timestamp and expiry of a signed record
+	FederationLimits      limiter.Store // rate limit of the signed records of every peer
+}
+
 type ReqLogic struct {
 	rateLimitStoreTCP       limiter.Store
 	rateLimitStoreUDP       limiter.Store
 	globalRateLimitStoreUDP limiter.Store
 	mu                      sync.RWMutex
-	store                   *cache.Cache
+	store                   cache.Store
+	batch                   *writeBatch // writes of the running update, guarded by mu
 	logger                  *zap.Logger
-	demoRoomName            string
 	tmpl                    *template.Template
+	settings                Settings
+	nonces                  *nonceCache
+	rawUpdates              *rawUpdates
+	watch                   *watchHub
+	cookies                 *cookieSecrets
+
+	serial   atomic.Uint32 // SOA serial of all zones, increased on every change
+	changed  chan struct{} // signals the notifier that the serial changed
+	journals map[string]*transferJournal
+
+	serialMu       sync.Mutex
+	serialReserved uint32 // serials up to this one are persisted in the store
+
+	replication *replicator // nil if replication is disabled
+	federation  *federation // nil if federation is disabled
 }
 
-func NewDNSHandler(rateLimitStoreTCP, rateLimitStore, globalRateLimitStore limiter.Store, store *cache.Cache, logger *zap.Logger, demoRoomName string, tmpl *template.Template) *ReqLogic {
-	return &ReqLogic{
+func NewDNSHandler(rateLimitStoreTCP, rateLimitStore, globalRateLimitStore limiter.Store, store cache.Store, logger *zap.Logger, tmpl *template.Template, settings Settings) *ReqLogic {
+	d := &ReqLogic{
 		rateLimitStoreTCP:       rateLimitStoreTCP,
 		rateLimitStoreUDP:       rateLimitStore,
 		globalRateLimitStoreUDP: globalRateLimitStore,
 		store:                   store,
 		logger:                  logger,
-		demoRoomName:            demoRoomName,
 		tmpl:                    tmpl,
+		settings:                settings,
+		nonces:                  newNonceCache(settings.NonceCacheSize, max(1, settings.NonceCacheSize/100)),
+		rawUpdates:              newRawUpdates(),
+		watch:                   newWatchHub(10000),
+		cookies:                 newCookieSecrets(settings.CookieRotation),
+		changed:                 make(chan struct{}, 1),
+		journals:                make(map[string]*transferJournal),
 	}
-}
 
-func StartDnsUdpServer(handler *ReqLogic) {
-	port := ":8053"
-	if IsProductionMode() {
-		port = ":53"
+	d.startSerial(time.Now())
+	for _, z := range settings.Zones.List() {
+		d.journals[z.Apex] = &transferJournal{size: settings.JournalSize}
+	}
+	if len(settings.ReplicationPeers) > 0 && len(settings.ReplicationSecret) > 0 {
+		d.replication = newReplicator(settings.ReplicationPeers, settings.ReplicationSecret)
+	}
+	if len(settings.FederationPeers) > 0 && len(settings.FederationSecrets) == len(settings.FederationPeers) && settings.FederationLimits != nil {
+		d.federation = newFederation(settings.FederationPeers, settings.FederationSecrets, settings.FederationLimits)
 	}
 
-	serverUDP := &dns.Server{Addr: port, Net: "udp"}
+	return d
+}
+
+func StartDnsUdpServer(handler *ReqLogic, addr string) {
+	// the read buffer has the advertised EDNS0 size, updates are only accepted over TCP
+	// where the sender can not be spoofed
+	serverUDP := &dns.Server{
+		Addr:       addr,
+		Net:        "udp",
+		UDPSize:    int(handler.settings.UDPSize),
+		TsigSecret: handler.settings.TSIGSecrets,
+	}
 	defer serverUDP.Shutdown()
 
 	dns.HandleFunc(".", handler.DNSReq)
 
-	log.Println("Starting DNS UDP server on port ", port, "...")
+	log.Println("Starting DNS UDP server on ", addr, "...")
 	err := serverUDP.ListenAndServe()
 	if err != nil {
 		log.Fatalf("Failed to start DNS server: %s\n", err)
 	}
 }
 
-func StartDnsTcpServer(handler *ReqLogic) {
-	port := ":8053"
-	if IsProductionMode() {
-		port = ":53"
-	}
-
-	serverUDP := &dns.Server{Addr: port, Net: "tcp"}
+func StartDnsTcpServer(handler *ReqLogic, addr string) {
+	serverUDP := &dns.Server{Addr: addr, Net: "tcp", TsigSecret: handler.settings.TSIGSecrets, MsgAcceptFunc: UpdateMsgAcceptFunc, DecorateReader: handler.DecorateReader}
 	defer serverUDP.Shutdown()
 
 	dns.HandleFunc(".", handler.DNSReq)
 
-	log.Println("Starting DNS TCP server on port ", port, "...")
+	log.Println("Starting DNS TCP server on ", addr, "...")
 	err := serverUDP.ListenAndServe()
 	if err != nil {
 		log.Fatalf("Failed to start DNS server: %s\n", err)
 	}
 }
 
-func IsProductionMode() bool {
-	prod := os.Getenv("PROD_MODE")
-	return (prod == "true")
+// StartDnsTlsServer serves DNS over TLS (RFC 7858), the certificate is reloaded when the files change.
+func StartDnsTlsServer(handler *ReqLogic, addr string, certFile string, keyFile string) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("Failed to start DNS over TLS server: %s\n", err)
+	}
+
+	serverTLS := &dns.Server{
+		Addr:           addr,
+		Net:            "tcp-tls",
+		TsigSecret:     handler.settings.TSIGSecrets,
+		MsgAcceptFunc:  UpdateMsgAcceptFunc,
+		DecorateReader: handler.DecorateReader,
+		TLSConfig: &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+	}
+	defer serverTLS.Shutdown()
+
+	dns.HandleFunc(".", handler.DNSReq)
+
+	log.Println("Starting DNS over TLS server on ", addr, "...")
+	err = serverTLS.ListenAndServe()
+	if err != nil {
+		log.Fatalf("Failed to start DNS over TLS server: %s\n", err)
+	}
 }
@@ -0,0 +1,147 @@
+package reqLogic
+
+import (
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"github.com/miekg/dns"
+)
+
+// handleSRVRequest answers _service._proto.<room>.room.<zone> with one SRV record per address
+// of every node in the room with a matching protocol. The service label is not checked,
+// since nodes do not register service names. Every address has its own target, see addressTarget,
+// its A or AAAA record is added to the additional section.
+func (d *ReqLogic) handleSRVRequest(msg *dns.Msg, q dns.Question, z *zone.Zone) {
+	name := z.Parse(q.Name)
+	if len(name.Labels) == 3 {
+		d.handleDNSSDInstanceSRV(msg, q, z, name)
+		return
+	}
+	if name.Kind != zone.NameRoom || len(name.Labels) != 2 || !utils.CheckIfSha224(name.ID) {
+		return
+	}
+
+	var protocol string
+	switch name.Labels[1] {
+	case "_tcp":
+		protocol = "tcp"
+	case "_udp":
+		protocol = "udp"
+	default:
+		return
+	}
+
+	now := time.Now()
+	for _, member := range d.getRoomNodes(name.ID) {
+		memberTTL := answerTTL(member, d.settings.RoomTTL, now)
+
+		for _, addr := range d.getNodeAddresses(member.Value) {
+			ip := net.ParseIP(addr.Address.Ip)
+			if addr.Address.Protocol != protocol || ip == nil {
+				continue
+			}
+			target := addressTarget(z, member.Value, ip)
+
+			srv := &dns.SRV{
+				Hdr: dns.RR_Header{
+					Name:   utils.ToLowerCase(q.Name),
+					Rrtype: dns.TypeSRV,
+					Class:  dns.ClassINET,
+					Ttl:    min(memberTTL, answerTTL(addr.Entry, d.settings.RoomTTL, now)),
+				},
+				Priority: 10,
+				Weight:   10,
+				Port:     uint16(addr.Address.Port),
+				Target:   target,
+			}
+			msg.Answer = append(msg.Answer, srv)
+			msg.Extra = append(msg.Extra, d.nodeAddressRecords(target, member.Value, addressType(ip), ip)...)
+		}
+	}
+
+	msg.Answer = dns.Dedup(msg.Answer, nil)
+	msg.Extra = dns.Dedup(msg.Extra, nil)
+}
+
+// addressTarget returns <ip>.<node>.node.<zone>, the SRV target of the addresses of a node with ip.
+// It only has that one IP, so a resolver can not pair the port with another IP of the node.
+// The label is the IP in hex, 8 digits for IPv4 and 32 for IPv6.
+func addressTarget(z *zone.Zone, node string, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return hex.EncodeToString(ip) + "." + z.NodeName(node)
+}
+
+// parseAddressLabel returns the IP of the first label of an addressTarget or nil.
+func parseAddressLabel(label string) net.IP {
+	ip, err := hex.DecodeString(label)
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return nil
+	}
+	return ip
+}
+
+// addressType returns the record type of ip, A or AAAA.
+func addressType(ip net.IP) uint16 {
+	if ip.To4() != nil {
+		return dns.TypeA
+	}
+	return dns.TypeAAAA
+}
+
+// handleNodeAddressRequest answers A and AAAA queries for <node>.node.<zone> with the IPs of the node
+// and for <ip>.<node>.node.<zone> with ip if the node has it. It reports false if the name is not a node name.
+func (d *ReqLogic) handleNodeAddressRequest(msg *dns.Msg, q dns.Question, z *zone.Zone) bool {
+	name := z.Parse(q.Name)
+	if name.Kind != zone.NameNode || len(name.Labels) > 1 || !utils.CheckIfSha224(name.ID) {
+		return false
+	}
+
+	var only net.IP
+	if len(name.Labels) == 1 {
+		if only = parseAddressLabel(name.Labels[0]); only == nil {
+			return false
+		}
+	}
+
+	msg.Answer = append(msg.Answer, d.nodeAddressRecords(utils.ToLowerCase(q.Name), name.ID, q.Qtype, only)...)
+	return true
+}
+
+// nodeAddressRecords returns one A or AAAA record per distinct IP of the node, only the record of only if it is set.
+func (d *ReqLogic) nodeAddressRecords(owner string, node string, qtype uint16, only net.IP) []dns.RR {
+	now := time.Now()
+	seen := make(map[string]bool)
+
+	var records []dns.RR
+	for _, addr := range d.getNodeAddresses(node) {
+		ip := net.ParseIP(addr.Address.Ip)
+		if ip == nil || seen[ip.String()] || (only != nil && !only.Equal(ip)) {
+			continue
+		}
+
+		hdr := dns.RR_Header{
+			Name:  owner,
+			Class: dns.ClassINET,
+			Ttl:   answerTTL(addr.Entry, d.settings.NodeTTL, now),
+		}
+
+		switch {
+		case qtype == dns.TypeA && ip.To4() != nil:
+			hdr.Rrtype = dns.TypeA
+			records = append(records, &dns.A{Hdr: hdr, A: ip.To4()})
+		case qtype == dns.TypeAAAA && ip.To4() == nil:
+			hdr.Rrtype = dns.TypeAAAA
+			records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		default:
+			continue
+		}
+		seen[ip.String()] = true
+	}
+
+	return records
+}
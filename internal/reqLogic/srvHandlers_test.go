@@ -0,0 +1,125 @@
+package reqLogic
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"github.com/miekg/dns"
+)
+
+func TestSRVTargetsPerAddress(t *testing.T) {
+	room := strings.Repeat("a", 56)
+	node := strings.Repeat("b", 56)
+	z := zone.New("example.org.", []string{"ns1.example.org."}, "hostmaster.example.org.")
+
+	tests := []struct {
+		name      string
+		addresses []string
+		query     string
+		want      map[uint16]string // port to the only IP of its target
+	}{
+		{
+			name:      "one target per ip",
+			addresses: []string{"tcp://192.0.2.1:80", "tcp://2001:db8::1:8080"},
+			query:     "_http._tcp." + z.RoomName(room),
+			want:      map[uint16]string{80: "192.0.2.1", 8080: "2001:db8::1"},
+		},
+		{
+			name:      "other protocol is skipped",
+			addresses: []string{"tcp://192.0.2.1:80", "udp://192.0.2.2:53"},
+			query:     "_dns._udp." + z.RoomName(room),
+			want:      map[uint16]string{53: "192.0.2.2"},
+		},
+		{
+			name:      "dns-sd instance",
+			addresses: []string{"tcp://192.0.2.1:80", "tcp://192.0.2.2:443"},
+			query:     node + "." + dnssdService + "._tcp." + z.RoomName(room),
+			want:      map[uint16]string{80: "192.0.2.1", 443: "192.0.2.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newRegistryTestLogic()
+			if err := d.RegisterNode(room, node, tt.addresses, 3600, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+
+			msg := new(dns.Msg)
+			d.handleSRVRequest(msg, dns.Question{Name: tt.query, Qtype: dns.TypeSRV, Qclass: dns.ClassINET}, z)
+			if len(msg.Answer) != len(tt.want) {
+				t.Fatalf("got %d SRV records, want %d:\n%v", len(msg.Answer), len(tt.want), msg.Answer)
+			}
+
+			for _, rr := range msg.Answer {
+				srv := rr.(*dns.SRV)
+				want, ok := tt.want[srv.Port]
+				if !ok {
+					t.Errorf("unexpected port %d", srv.Port)
+					continue
+				}
+
+				ip := net.ParseIP(want)
+				qtype := addressType(ip)
+				answer := new(dns.Msg)
+				if !d.handleNodeAddressRequest(answer, dns.Question{Name: srv.Target, Qtype: qtype, Qclass: dns.ClassINET}, z) {
+					t.Fatalf("target %s is not a node name", srv.Target)
+				}
+				if len(answer.Answer) != 1 || !ipOf(answer.Answer[0]).Equal(ip) {
+					t.Errorf("target %s of port %d has %v, want only %s", srv.Target, srv.Port, answer.Answer, want)
+				}
+
+				extra := 0
+				for _, rr := range msg.Extra {
+					if rr.Header().Name == srv.Target {
+						extra++
+					}
+				}
+				if extra != 1 {
+					t.Errorf("target %s has %d additional records, want 1", srv.Target, extra)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAddressLabel(t *testing.T) {
+	tests := []struct {
+		label string
+		want  string // "" if the label is no address
+	}{
+		{label: "c0000201", want: "192.0.2.1"},
+		{label: "20010db8000000000000000000000001", want: "2001:db8::1"},
+		{label: "c00002", want: ""},
+		{label: "not-hex!", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			got := parseAddressLabel(tt.label)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("parseAddressLabel(%q) = %s, want nil", tt.label, got)
+				}
+				return
+			}
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("parseAddressLabel(%q) = %s, want %s", tt.label, got, tt.want)
+			}
+		})
+	}
+}
+
+// ipOf returns the IP of an A or AAAA record.
+func ipOf(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package reqLogic
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// transferJournal keeps the last transferred snapshot of a zone and the differences between
+// the snapshots, so secondaries can update with IXFR (RFC 1995) instead of a full AXFR.
+type transferJournal struct {
+	mu      sync.Mutex
+	size    int
+	serial  uint32
+	records map[string]dns.RR // snapshot at serial by presentation format
+	deltas  []journalDelta
+}
+
+// journalDelta is the change of a zone from one serial to the next.
+type journalDelta struct {
+	from    uint32
+	to      uint32
+	removed []dns.RR
+	added   []dns.RR
+}
+
+// sync updates the snapshot to serial with build if it is older and records the difference.
+// It returns the records of the snapshot and the journal.
+func (j *transferJournal) sync(serial uint32, build func() []dns.RR) ([]dns.RR, []journalDelta) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.records == nil || j.serial != serial {
+		records := make(map[string]dns.RR)
+		for _, rr := range build() {
+			records[rr.String()] = rr
+		}
+
+		if j.records != nil {
+			delta := journalDelta{from: j.serial, to: serial}
+			for key, rr := range j.records {
+				if _, ok := records[key]; !ok {
+					delta.removed = append(delta.removed, rr)
+				}
+			}
+			for key, rr := range records {
+				if _, ok := j.records[key]; !ok {
+					delta.added = append(delta.added, rr)
+				}
+			}
+			sortRecords(delta.removed)
+			sortRecords(delta.added)
+
+			j.deltas = append(j.deltas, delta)
+			if len(j.deltas) > j.size {
+				j.deltas = j.deltas[len(j.deltas)-j.size:]
+			}
+		}
+
+		j.serial = serial
+		j.records = records
+	}
+
+	records := make([]dns.RR, 0, len(j.records))
+	for _, rr := range j.records {
+		records = append(records, rr)
+	}
+	sortRecords(records)
+
+	return records, j.deltas
+}
+
+// deltasSince returns the chain of deltas from serial to the newest snapshot, false if serial is not in the journal.
+func deltasSince(deltas []journalDelta, serial uint32) ([]journalDelta, bool) {
+	for i, delta := range deltas {
+		if delta.from == serial {
+			return deltas[i:], true
+		}
+	}
+	return nil, false
+}
+
+func sortRecords(records []dns.RR) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Header().Name != records[j].Header().Name {
+			return records[i].Header().Name < records[j].Header().Name
+		}
+		return records[i].String() < records[j].String()
+	})
+}
+
+const (
+	serialKey = "meta:serial"
+
+	// serials are reserved in blocks, so the store is not written on every change
+	serialReserve = 1000
+)
+
+// startSerial continues after the serials that were reserved before a restart, but starts at the
+// current time at least. So the serial never goes backwards, even if the clock did.
+func (d *ReqLogic) startSerial(now time.Time) {
+	serial := uint32(now.Unix())
+	if reserved, err := d.loadSerial(); err != nil {
+		d.logger.Error("Failed to load the SOA serial", zap.Error(err))
+	} else if reserved >= serial {
+		serial = reserved + 1
+	}
+
+	d.serial.Store(serial)
+	d.reserveSerials(serial)
+}
+
+// loadSerial returns the last reserved serial, 0 if none was reserved yet.
+func (d *ReqLogic) loadSerial() (uint32, error) {
+	d.mu.RLock()
+	entries, err := d.loadEntries(serialKey, time.Now())
+	d.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// a restored snapshot can add a second serial, the larger one wins
+	reserved := uint32(0)
+	for _, entry := range entries {
+		if serial, err := strconv.ParseUint(entry.Value, 10, 32); err == nil {
+			reserved = max(reserved, uint32(serial))
+		}
+	}
+	return reserved, nil
+}
+
+// reserveSerials persists the end of the next block of serials when serial used up the reserved ones.
+func (d *ReqLogic) reserveSerials(serial uint32) {
+	d.serialMu.Lock()
+	defer d.serialMu.Unlock()
+
+	if serial < d.serialReserved {
+		return
+	}
+
+	reserved := serial + serialReserve
+	data, err := cache.EncodeEntries([]cache.Entry{{Value: strconv.FormatUint(uint64(reserved), 10)}})
+	if err == nil {
+		err = d.store.Set([]byte(serialKey), data, 0)
+	}
+	if err != nil {
+		d.logger.Error("Failed to save the SOA serial", zap.Uint32("serial", reserved), zap.Error(err))
+		return
+	}
+	d.serialReserved = reserved
+}
+
+// ZonesChanged increases the SOA serial of the zones and wakes up the notifier.
+func (d *ReqLogic) ZonesChanged() {
+	d.reserveSerials(d.serial.Add(1))
+
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// zoneRecords returns all records of z except the SOA. The dynamic records are built with the
+// same handlers as the answers, the SRV records of a room as wildcards since the service label is free.
+// Their TTL is the configured maximum, the remaining lifetime would change with every snapshot.
+func (d *ReqLogic) zoneRecords(z *zone.Zone) []dns.RR {
+	msg := new(dns.Msg)
+	ask := func(name string, qtype uint16) []dns.RR {
+		msg.Answer = nil
+		d.answerQuestion(msg, dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}, z)
+		return msg.Answer
+	}
+
+	records := ask(z.Apex, dns.TypeNS)
+	records = append(records, z.Records().All()...)
+
+	d.mu.RLock()
+	roomKeys := d.store.Keys("room:")
+	nodeKeys := d.store.Keys("node:")
+	d.mu.RUnlock()
+
+	for _, key := range roomKeys {
+		room := z.RoomName(strings.TrimPrefix(key, "room:"))
+
+		records = append(records, ask(room, dns.TypeTXT)...)
+		for _, browse := range []string{"b._dns-sd._udp.", "lb._dns-sd._udp.", "_services._dns-sd._udp."} {
+			records = append(records, ask(browse+room, dns.TypePTR)...)
+		}
+
+		for _, protoLabel := range []string{"_tcp", "_udp"} {
+			records = append(records, ask("*."+protoLabel+"."+room, dns.TypeSRV)...)
+
+			instances := ask(dnssdService+"."+protoLabel+"."+room, dns.TypePTR)
+			records = append(records, instances...)
+			for _, instance := range instances {
+				target := instance.(*dns.PTR).Ptr
+				records = append(records, ask(target, dns.TypeSRV)...)
+				records = append(records, ask(target, dns.TypeTXT)...)
+			}
+		}
+	}
+
+	for _, key := range nodeKeys {
+		id := strings.TrimPrefix(key, "node:")
+		node := z.NodeName(id)
+		for _, qtype := range []uint16{dns.TypeTXT, dns.TypeA, dns.TypeAAAA} {
+			records = append(records, ask(node, qtype)...)
+		}
+
+		// the SRV targets of the addresses
+		seen := make(map[string]bool)
+		for _, addr := range d.getNodeAddresses(id) {
+			ip := net.ParseIP(addr.Address.Ip)
+			if ip == nil || seen[ip.String()] {
+				continue
+			}
+			seen[ip.String()] = true
+			records = append(records, ask(addressTarget(z, id, ip), addressType(ip))...)
+		}
+	}
+
+	for _, rr := range records {
+		switch z.Parse(rr.Header().Name).Kind {
+		case zone.NameRoom:
+			rr.Header().Ttl = d.settings.RoomTTL
+		case zone.NameNode:
+			rr.Header().Ttl = d.settings.NodeTTL
+		}
+	}
+
+	return records
+}
+
+// transferAllowed checks the source address and the TSIG signature of a zone transfer.
+// Without an ACL and TSIG keys transfers are disabled.
+func (d *ReqLogic) transferAllowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(d.settings.TransferAllowFrom) == 0 && len(d.settings.TSIGSecrets) == 0 {
+		return false
+	}
+	if _, ok := w.(*dohResponseWriter); ok {
+		return false
+	}
+
+	if len(d.settings.TransferAllowFrom) > 0 {
+		ip := net.ParseIP(getIPFromRemoteAddr(w.RemoteAddr().String()))
+		allowed := false
+		for _, network := range d.settings.TransferAllowFrom {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	if len(d.settings.TSIGSecrets) > 0 && (r.IsTsig() == nil || w.TsigStatus() != nil) {
+		return false
+	}
+
+	return true
+}
+
+// handleTransfer answers AXFR and IXFR queries for the apex of z.
+func (d *ReqLogic) handleTransfer(w dns.ResponseWriter, r *dns.Msg, q dns.Question, z *zone.Zone) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		msg.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+
+	if !d.transferAllowed(w, r) || dns.CanonicalName(q.Name) != z.Apex {
+		d.logger.Warn("Refused zone transfer", zap.String("remote_addr", w.RemoteAddr().String()), zap.String("zone", q.Name))
+		msg.Rcode = dns.RcodeRefused
+		w.WriteMsg(msg)
+		return
+	}
+
+	soa := d.newSOA(z)
+	records, deltas := d.journals[z.Apex].sync(soa.Serial, func() []dns.RR { return d.zoneRecords(z) })
+
+	var answer []dns.RR
+	if q.Qtype == dns.TypeIXFR {
+		answer = ixfrAnswer(r, soa, deltas)
+		if answer == nil && IsUDPRequest(w.RemoteAddr()) {
+			// the client has to retry over TCP (RFC 1995 4)
+			answer = []dns.RR{soa}
+		}
+	}
+	if answer == nil {
+		if IsUDPRequest(w.RemoteAddr()) {
+			moveToTCP(msg, w, r)
+			return
+		}
+		answer = append(append([]dns.RR{soa}, records...), soa)
+	}
+
+	if len(answer) == 1 {
+		msg.Answer = answer
+		w.WriteMsg(msg)
+		return
+	}
+
+	// stream the transfer in messages of up to 200 records
+	ch := make(chan *dns.Envelope, len(answer)/200+1)
+	for len(answer) > 0 {
+		n := min(len(answer), 200)
+		ch <- &dns.Envelope{RR: answer[:n]}
+		answer = answer[n:]
+	}
+	close(ch)
+
+	transfer := new(dns.Transfer)
+	if err := transfer.Out(w, r, ch); err != nil {
+		d.logger.Error("Failed to send zone transfer", zap.String("zone", z.Apex), zap.Error(err))
+		return
+	}
+	d.logger.Info("Sent zone transfer", zap.String("remote_addr", w.RemoteAddr().String()),
+		zap.String("zone", z.Apex), zap.String("type", dns.TypeToString[q.Qtype]), zap.Uint32("serial", soa.Serial))
+}
+
+// ixfrAnswer returns the IXFR answer from the serial in the authority section of r to soa,
+// a single SOA if the client is up to date and nil if the serial is not in the journal.
+func ixfrAnswer(r *dns.Msg, soa *dns.SOA, deltas []journalDelta) []dns.RR {
+	if len(r.Ns) == 0 {
+		return nil
+	}
+	clientSOA, ok := r.Ns[0].(*dns.SOA)
+	if !ok {
+		return nil
+	}
+	if clientSOA.Serial == soa.Serial {
+		return []dns.RR{soa}
+	}
+
+	chain, ok := deltasSince(deltas, clientSOA.Serial)
+	if !ok {
+		return nil
+	}
+
+	withSerial := func(serial uint32) *dns.SOA {
+		s := dns.Copy(soa).(*dns.SOA)
+		s.Serial = serial
+		return s
+	}
+
+	answer := []dns.RR{soa}
+	for _, delta := range chain {
+		answer = append(answer, withSerial(delta.from))
+		answer = append(answer, delta.removed...)
+		answer = append(answer, withSerial(delta.to))
+		answer = append(answer, delta.added...)
+	}
+	return append(answer, soa)
+}
+
+// StartNotifier sends a NOTIFY (RFC 1996) for every zone to the secondaries when the zones changed,
+// at most once per interval.
+func (d *ReqLogic) StartNotifier(interval time.Duration) {
+	if len(d.settings.Secondaries) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range d.changed {
+		serial := d.serial.Load()
+		for _, z := range d.settings.Zones.List() {
+			// record the change in the journal, so the secondaries can get it with IXFR
+			d.journals[z.Apex].sync(serial, func() []dns.RR { return d.zoneRecords(z) })
+
+			for _, secondary := range d.settings.Secondaries {
+				go d.sendNotify(z, secondary)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func (d *ReqLogic) sendNotify(z *zone.Zone, secondary string) {
+	msg := new(dns.Msg)
+	msg.SetNotify(z.Apex)
+	msg.Answer = []dns.RR{d.newSOA(z)}
+
+	client := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+	if d.settings.NotifyKey != "" {
+		client.TsigSecret = d.settings.TSIGSecrets
+		msg.SetTsig(d.settings.NotifyKey, d.settings.NotifyAlgorithm, 300, time.Now().Unix())
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		response, _, err := client.Exchange(msg, secondary)
+		if err == nil && response.Rcode == dns.RcodeSuccess {
+			return
+		}
+		if err == nil {
+			d.logger.Warn("Secondary refused NOTIFY", zap.String("secondary", secondary), zap.String("zone", z.Apex),
+				zap.String("rcode", dns.RcodeToString[response.Rcode]))
+			return
+		}
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	d.logger.Warn("Failed to send NOTIFY", zap.String("secondary", secondary), zap.String("zone", z.Apex))
+}
@@ -0,0 +1,233 @@
+package reqLogic
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func mustRRs(t *testing.T, records ...string) []dns.RR {
+	t.Helper()
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("invalid record %q: %v", s, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	out := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		out = append(out, rr.String())
+	}
+	return out
+}
+
+func concat(parts ...[]dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, part := range parts {
+		rrs = append(rrs, part...)
+	}
+	return rrs
+}
+
+func TestTransferJournalSync(t *testing.T) {
+	a := "a.example.org. 60 IN A 192.0.2.1"
+	b := "b.example.org. 60 IN A 192.0.2.2"
+	c := "c.example.org. 60 IN A 192.0.2.3"
+
+	type snapshot struct {
+		serial  uint32
+		records []string
+	}
+	type delta struct {
+		from, to       uint32
+		removed, added []string
+	}
+
+	tests := []struct {
+		name        string
+		size        int
+		snapshots   []snapshot
+		wantRecords []string
+		wantDeltas  []delta
+	}{
+		{
+			name:        "first snapshot has no delta",
+			size:        10,
+			snapshots:   []snapshot{{1, []string{a, b}}},
+			wantRecords: []string{a, b},
+		},
+		{
+			name:        "same serial is not rebuilt",
+			size:        10,
+			snapshots:   []snapshot{{1, []string{a}}, {1, []string{a, b}}},
+			wantRecords: []string{a},
+		},
+		{
+			name:        "added and removed records",
+			size:        10,
+			snapshots:   []snapshot{{1, []string{a, b}}, {2, []string{b, c}}},
+			wantRecords: []string{b, c},
+			wantDeltas: []delta{
+				{from: 1, to: 2, removed: []string{a}, added: []string{c}},
+			},
+		},
+		{
+			name:        "journal keeps the newest deltas",
+			size:        2,
+			snapshots:   []snapshot{{1, []string{a}}, {2, []string{a, b}}, {3, []string{b}}, {4, []string{b, c}}},
+			wantRecords: []string{b, c},
+			wantDeltas: []delta{
+				{from: 2, to: 3, removed: []string{a}},
+				{from: 3, to: 4, added: []string{c}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &transferJournal{size: tt.size}
+
+			var records []dns.RR
+			var deltas []journalDelta
+			for _, s := range tt.snapshots {
+				records, deltas = j.sync(s.serial, func() []dns.RR { return mustRRs(t, s.records...) })
+			}
+
+			if got := rrStrings(records); !slices.Equal(got, rrStrings(mustRRs(t, tt.wantRecords...))) {
+				t.Errorf("records = %v, want %v", got, tt.wantRecords)
+			}
+
+			if len(deltas) != len(tt.wantDeltas) {
+				t.Fatalf("got %d deltas, want %d", len(deltas), len(tt.wantDeltas))
+			}
+			for i, want := range tt.wantDeltas {
+				got := deltas[i]
+				if got.from != want.from || got.to != want.to {
+					t.Errorf("delta %d goes from %d to %d, want %d to %d", i, got.from, got.to, want.from, want.to)
+				}
+				if !slices.Equal(rrStrings(got.removed), rrStrings(mustRRs(t, want.removed...))) {
+					t.Errorf("delta %d removed %v, want %v", i, rrStrings(got.removed), want.removed)
+				}
+				if !slices.Equal(rrStrings(got.added), rrStrings(mustRRs(t, want.added...))) {
+					t.Errorf("delta %d added %v, want %v", i, rrStrings(got.added), want.added)
+				}
+			}
+		})
+	}
+}
+
+func TestIxfrAnswer(t *testing.T) {
+	a := mustRRs(t, "a.example.org. 60 IN A 192.0.2.1")
+	b := mustRRs(t, "b.example.org. 60 IN A 192.0.2.2")
+	deltas := []journalDelta{
+		{from: 1, to: 2, added: a},
+		{from: 2, to: 3, removed: a, added: b},
+	}
+
+	soa := func(serial uint32) *dns.SOA {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:     "ns.example.org.",
+			Mbox:   "hostmaster.example.org.",
+			Serial: serial,
+		}
+	}
+	request := func(ns ...dns.RR) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetIxfr("example.org.", 0, "", "")
+		r.Ns = ns
+		return r
+	}
+
+	tests := []struct {
+		name string
+		r    *dns.Msg
+		want []dns.RR // nil means a full transfer
+	}{
+		{
+			name: "no SOA of the client",
+			r:    request(),
+			want: nil,
+		},
+		{
+			name: "client is up to date",
+			r:    request(soa(3)),
+			want: []dns.RR{soa(3)},
+		},
+		{
+			name: "one delta",
+			r:    request(soa(2)),
+			want: concat([]dns.RR{soa(3)}, []dns.RR{soa(2)}, a, []dns.RR{soa(3)}, b, []dns.RR{soa(3)}),
+		},
+		{
+			name: "chain of deltas",
+			r:    request(soa(1)),
+			want: concat([]dns.RR{soa(3)}, []dns.RR{soa(1), soa(2)}, a, []dns.RR{soa(2)}, a, []dns.RR{soa(3)}, b, []dns.RR{soa(3)}),
+		},
+		{
+			name: "serial is not in the journal",
+			r:    request(soa(7)),
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ixfrAnswer(tt.r, soa(3), deltas)
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("answer = %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(rrStrings(got), rrStrings(tt.want)) {
+				t.Errorf("answer =\n%v\nwant\n%v", rrStrings(got), rrStrings(tt.want))
+			}
+		})
+	}
+}
+
+func TestStartSerial(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name      string
+		persisted string // reserved serial in the store, none if empty
+		want      uint32
+	}{
+		{name: "nothing persisted starts at the time", want: 1700000000},
+		{name: "older serial starts at the time", persisted: "1600000000", want: 1700000000},
+		{name: "newer serial continues after it", persisted: "1800000000", want: 1800000001},
+		{name: "invalid serial starts at the time", persisted: "x", want: 1700000000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &ReqLogic{store: cache.NewMemoryStore(), logger: zap.NewNop()}
+			if tt.persisted != "" {
+				data, _ := cache.EncodeEntries([]cache.Entry{{Value: tt.persisted}})
+				d.store.Set([]byte(serialKey), data, 0)
+			}
+
+			d.startSerial(now)
+			if got := d.serial.Load(); got != tt.want {
+				t.Fatalf("serial = %d, want %d", got, tt.want)
+			}
+
+			// the next start continues after the reserved serials
+			next := &ReqLogic{store: d.store, logger: zap.NewNop()}
+			next.startSerial(now)
+			if got := next.serial.Load(); got != tt.want+serialReserve+1 {
+				t.Errorf("serial after restart = %d, want %d", got, tt.want+serialReserve+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package reqLogic
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/auth"
+	"github.com/i5heu/PathfinderBeacon/pkg/dnssec"
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// UpdateMsgAcceptFunc accepts dynamic updates (RFC 2136) in addition to the messages of dns.DefaultMsgAcceptFunc.
+// An update has at most one address per record, so the update section is limited like the addresses of a registration.
+// It is only used for TCP and DNS over TLS, the UDP server rejects updates.
+func UpdateMsgAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode != dns.OpcodeUpdate || dh.Bits&(1<<15) != 0 {
+		return dns.DefaultMsgAcceptFunc(dh)
+	}
+
+	// zone, prerequisites, updates and OPT + SIG(0)
+	if dh.Qdcount != 1 || dh.Ancount > 10 || dh.Nscount > 101 || dh.Arcount > 2 {
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+// nodeUpdate collects the changes of one node in an update.
+type nodeUpdate struct {
+	removeAll bool
+	remove    []string
+	add       []string
+	ttl       int
+}
+
+// handleUpdate registers and deregisters nodes with a dynamic update (RFC 2136) of TXT records
+// at <node>.node.<zone>, in the same format as the node TXT answers, e.g. "tcp://192.0.2.1:80".
+// The update is signed with SIG(0) (RFC 2931) by the room key, the signer is <room>.room.<zone> and the
+// KEY record of the room is added in the update section, so the server can check that it belongs to the room.
+func (d *ReqLogic) handleUpdate(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg, z *zone.Zone) {
+	host := getIPFromRemoteAddr(w.RemoteAddr().String())
+
+	// the sender of a UDP message can be spoofed
+	if IsUDPRequest(w.RemoteAddr()) {
+		msg.Rcode = dns.RcodeRefused
+		w.WriteMsg(msg)
+		return
+	}
+
+	// the wire format of the update, DNS over HTTPS has it in the writer
+	raw := d.rawUpdates.take(w.RemoteAddr(), r.Id)
+	if doh, ok := w.(*dohResponseWriter); ok {
+		raw = doh.raw
+	}
+
+	rcode, err := d.applyUpdate(r, raw, z, host)
+	if err != nil {
+		d.logger.Warn("Rejected DNS update", zap.String("remote_addr", w.RemoteAddr().String()),
+			zap.String("rcode", dns.RcodeToString[rcode]), zap.Error(err))
+	}
+
+	msg.Rcode = rcode
+	if err := w.WriteMsg(msg); err != nil {
+		d.logger.Info("Failed to write message", zap.Error(err), zap.String("remote_addr", w.RemoteAddr().String()))
+	}
+}
+
+// applyUpdate verifies the update and applies it, it returns the rcode of the answer.
+// raw is the update as received, r was unpacked from it.
+func (d *ReqLogic) applyUpdate(r *dns.Msg, raw []byte, z *zone.Zone, host string) (int, error) {
+	q := r.Question[0]
+	if q.Qtype != dns.TypeSOA || dns.CanonicalName(q.Name) != z.Apex {
+		return dns.RcodeNotAuth, fmt.Errorf("zone %s is not a zone of the server", q.Name)
+	}
+	if len(r.Answer) > 0 {
+		return dns.RcodeNotImplemented, fmt.Errorf("prerequisites are not supported")
+	}
+
+	// limit like HTTP registrations before verifying, the signature is the expensive part
+	if d.settings.RegisterLimits != nil {
+		_, _, _, ok, err := d.settings.RegisterLimits.Take(context.Background(), host)
+		if err != nil || !ok {
+			return dns.RcodeRefused, fmt.Errorf("too many registrations")
+		}
+	}
+
+	room, key, signed, err := d.verifyUpdateSignature(r, raw, z, host)
+	if err != nil {
+		return dns.RcodeNotAuth, err
+	}
+
+	// check all records before changing anything, an update is applied completely or not at all
+	nodes := make(map[string]*nodeUpdate)
+	for _, rr := range r.Ns {
+		if rr == dns.RR(key) {
+			continue
+		}
+
+		hdr := rr.Header()
+		name := z.Parse(hdr.Name)
+		if name.Kind != zone.NameNode || len(name.Labels) > 0 {
+			return dns.RcodeRefused, fmt.Errorf("%s is not a node name", hdr.Name)
+		}
+
+		node := updateNodeName(room, name.ID, host)
+		update := nodes[node]
+		if update == nil {
+			update = &nodeUpdate{ttl: d.settings.RegistrationTTL}
+			nodes[node] = update
+		}
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			// delete the node, only TXT records can be written
+			if hdr.Rrtype != dns.TypeTXT && hdr.Rrtype != dns.TypeANY {
+				return dns.RcodeRefused, fmt.Errorf("only TXT records of nodes can be updated")
+			}
+			update.removeAll = true
+		case dns.ClassNONE, dns.ClassINET:
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				return dns.RcodeRefused, fmt.Errorf("only TXT records of nodes can be updated")
+			}
+			addresses, err := parseUpdateAddresses(txt)
+			if err != nil {
+				return dns.RcodeFormatError, err
+			}
+
+			if hdr.Class == dns.ClassNONE {
+				update.remove = append(update.remove, addresses...)
+				continue
+			}
+			update.add = append(update.add, addresses...)
+			if hdr.Ttl > 0 {
+				update.ttl = min(update.ttl, int(hdr.Ttl))
+			}
+			if len(update.add) > 50 {
+				return dns.RcodeRefused, fmt.Errorf("too many addresses")
+			}
+		default:
+			return dns.RcodeFormatError, fmt.Errorf("invalid class %s", dns.ClassToString[hdr.Class])
+		}
+	}
+
+	for node, update := range nodes {
+		// deletions first, so an update can replace the addresses of a node
+		if update.removeAll || len(update.remove) > 0 {
+			addresses := update.remove
+			if update.removeAll {
+				addresses = nil
+			}
+			if err := d.DeregisterNode(room, node, addresses, signed); err != nil {
+				return dns.RcodeServerFailure, err
+			}
+		}
+
+		if len(update.add) > 0 {
+			ttl := update.ttl
+			if d.settings.DemoRoomName == room {
+				ttl = 0
+			}
+			if err := d.RegisterNode(room, node, update.add, ttl, signed); err != nil {
+				return dns.RcodeServerFailure, err
+			}
+		}
+
+		d.logger.Info("Node updated via DNS", zap.String("room", room), zap.String("node", node),
+			zap.Strings("added", update.add), zap.Strings("removed", update.remove), zap.Bool("removed_all", update.removeAll))
+	}
+
+	return dns.RcodeSuccess, nil
+}
+
+// verifyUpdateSignature checks the SIG(0) signature of r and returns the room, the KEY record of the signer
+// and the signed inception time, which orders the update like the timestamp of a v2 registration.
+// Every signature can only be used once, like the nonce of a v2 registration.
+func (d *ReqLogic) verifyUpdateSignature(r *dns.Msg, raw []byte, z *zone.Zone, host string) (string, *dns.KEY, time.Time, error) {
+	if len(r.Extra) == 0 {
+		return "", nil, time.Time{}, fmt.Errorf("update is not signed with SIG(0)")
+	}
+	sig, ok := r.Extra[len(r.Extra)-1].(*dns.SIG)
+	if !ok {
+		return "", nil, time.Time{}, fmt.Errorf("update is not signed with SIG(0)")
+	}
+
+	signer := z.Parse(sig.SignerName)
+	if signer.Kind != zone.NameRoom || len(signer.Labels) > 0 || !utils.CheckIfSha224(signer.ID) {
+		return "", nil, time.Time{}, fmt.Errorf("signer %s is not a room", sig.SignerName)
+	}
+	room := signer.ID
+
+	var key *dns.KEY
+	for _, rr := range r.Ns {
+		if k, ok := rr.(*dns.KEY); ok && rr.Header().Class == dns.ClassINET && dns.CanonicalName(k.Hdr.Name) == dns.CanonicalName(sig.SignerName) {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return "", nil, time.Time{}, fmt.Errorf("update has no KEY record of the room")
+	}
+
+	publicKey, err := dnssec.PublicKey(&key.DNSKEY)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	roomNames, err := auth.RoomNamesFromKey(publicKey)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	if !slices.Contains(roomNames, room) {
+		return "", nil, time.Time{}, fmt.Errorf("room does not belong to the KEY record")
+	}
+
+	// short lived signatures only, they are remembered until they expire
+	if time.Duration(sig.Expiration-sig.Inception)*time.Second > 2*d.settings.MaxClockSkew {
+		return "", nil, time.Time{}, fmt.Errorf("SIG(0) validity is longer than %s", 2*d.settings.MaxClockSkew)
+	}
+	if err := verifySIG0(r, raw, sig, key); err != nil {
+		return "", nil, time.Time{}, fmt.Errorf("Failed to verify SIG(0): %v", err)
+	}
+
+	now := time.Now()
+	err = d.nonces.Use(nonceOwner(host), room+":sig0:"+sig.Signature, time.Unix(int64(sig.Expiration), 0), now)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+
+	return room, key, time.Unix(int64(sig.Inception), 0), nil
+}
+
+// verifySIG0 verifies sig over raw, the wire format of r. The signature covers the message as it was
+// sent, packing r again can change the name compression and the order of the records.
+func verifySIG0(r *dns.Msg, raw []byte, sig *dns.SIG, key *dns.KEY) error {
+	if raw == nil {
+		return fmt.Errorf("the wire format of the update is missing")
+	}
+
+	// another message of the sender with the same ID could have replaced it
+	m := new(dns.Msg)
+	if err := m.Unpack(raw); err != nil || m.String() != r.String() {
+		return fmt.Errorf("the wire format does not match the update")
+	}
+	return sig.Verify(key, raw)
+}
+
+// updateNodeName returns the node name for the label of an updated record. The name derived from the
+// address of the sender is used as is, every other label is a node id like in v2 registrations.
+func updateNodeName(room string, label string, host string) string {
+	if label == getNodeName(host) {
+		return label
+	}
+	return utils.NodeNameFromID(room, label)
+}
+
+// parseUpdateAddresses returns the addresses of the strings of txt in the stored form.
+func parseUpdateAddresses(txt *dns.TXT) ([]string, error) {
+	addresses := make([]string, 0, len(txt.Txt))
+	for _, s := range txt.Txt {
+		addr, err := utils.ParseAddress(s)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateAddress(addr); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, utils.FormatAddress(addr))
+	}
+	return addresses, nil
+}
@@ -0,0 +1,225 @@
+package reqLogic
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/auth"
+	"github.com/i5heu/PathfinderBeacon/pkg/cache"
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"github.com/i5heu/PathfinderBeacon/pkg/zone"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// roomKEY returns the KEY record of key (RFC 3110, RFC 6605 and RFC 8080) at signer.
+func roomKEY(t *testing.T, key *auth.Key, signer string) *dns.KEY {
+	t.Helper()
+
+	k := &dns.KEY{DNSKEY: dns.DNSKEY{
+		Hdr:      dns.RR_Header{Name: signer, Rrtype: dns.TypeKEY, Class: dns.ClassINET},
+		Flags:    0x200,
+		Protocol: 3,
+	}}
+	switch pk := key.PrivateKey.Public().(type) {
+	case ed25519.PublicKey:
+		k.Algorithm = dns.ED25519
+		k.PublicKey = base64.StdEncoding.EncodeToString(pk)
+	case *ecdsa.PublicKey:
+		k.Algorithm = dns.ECDSAP256SHA256
+		k.PublicKey = base64.StdEncoding.EncodeToString(append(pk.X.FillBytes(make([]byte, 32)), pk.Y.FillBytes(make([]byte, 32))...))
+	case *rsa.PublicKey:
+		k.Algorithm = dns.RSASHA256
+		e := big.NewInt(int64(pk.E)).Bytes()
+		raw := append([]byte{byte(len(e))}, e...)
+		k.PublicKey = base64.StdEncoding.EncodeToString(append(raw, pk.N.Bytes()...))
+	default:
+		t.Fatalf("unsupported key %T", pk)
+	}
+	return k
+}
+
+func TestApplyUpdate(t *testing.T) {
+	z := zone.New("example.org.", []string{"ns1.example.org."}, "hostmaster.example.org.")
+	now := time.Now()
+
+	ed25519Key, err := auth.GenerateKeyWithAlgorithm(auth.AlgorithmEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := auth.GenerateKeyWithAlgorithm(auth.AlgorithmECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := auth.GenerateKeyWithAlgorithm(auth.AlgorithmRSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := auth.GenerateKeyWithAlgorithm(auth.AlgorithmEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the room of an RSA key that was registered with its PKIX pem
+	rsaPKIXRoom := func() string {
+		names, err := auth.RoomNamesFromKey(rsaKey.PrivateKey.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names[1]
+	}()
+
+	tests := []struct {
+		name      string
+		key       *auth.Key // signs the update and is sent as KEY record
+		signKey   *auth.Key // signs the update instead of key
+		room      string    // of the signer, the room of key if empty
+		validity  time.Duration
+		unsigned  bool
+		tamper    func(r *dns.Msg) // after signing
+		replay    bool             // apply the same update twice
+		wantRcode int
+		wantNode  bool // the address is registered
+	}{
+		{name: "ed25519", key: ed25519Key, wantRcode: dns.RcodeSuccess, wantNode: true},
+		{name: "ecdsa", key: ecdsaKey, wantRcode: dns.RcodeSuccess, wantNode: true},
+		{name: "rsa", key: rsaKey, wantRcode: dns.RcodeSuccess, wantNode: true},
+		{name: "rsa room of the pkix pem", key: rsaKey, room: rsaPKIXRoom, wantRcode: dns.RcodeSuccess, wantNode: true},
+		{name: "replayed signature", key: ed25519Key, replay: true, wantRcode: dns.RcodeNotAuth, wantNode: true},
+		{name: "key of another room", key: ecdsaKey, room: ed25519Key.GetRoomName(), wantRcode: dns.RcodeNotAuth},
+		{name: "signed by another key", key: ed25519Key, signKey: otherKey, wantRcode: dns.RcodeNotAuth},
+		{name: "unsigned", key: ed25519Key, unsigned: true, wantRcode: dns.RcodeNotAuth},
+		{name: "signature valid for too long", key: ed25519Key, validity: time.Hour, wantRcode: dns.RcodeNotAuth},
+		{
+			name:      "changed after signing",
+			key:       ed25519Key,
+			tamper:    func(r *dns.Msg) { r.Ns[1].(*dns.TXT).Txt = []string{"tcp://192.0.2.99:80"} },
+			wantRcode: dns.RcodeNotAuth,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &ReqLogic{
+				store:  cache.NewMemoryStore(),
+				logger: zap.NewNop(),
+				watch:  newWatchHub(100),
+				nonces: newNonceCache(100, 100),
+				settings: Settings{
+					RegistrationTTL: 3600,
+					MaxClockSkew:    5 * time.Minute,
+				},
+			}
+
+			room := tt.room
+			if room == "" {
+				room = tt.key.GetRoomName()
+			}
+			signer := z.RoomName(room)
+			validity := tt.validity
+			if validity == 0 {
+				validity = time.Minute
+			}
+
+			m := new(dns.Msg)
+			m.SetUpdate(z.Apex)
+			m.Ns = append(m.Ns, roomKEY(t, tt.key, signer))
+			txt, err := dns.NewRR(`dev1.node.example.org. 600 IN TXT "tcp://192.0.2.1:80"`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Insert([]dns.RR{txt})
+
+			raw, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.unsigned {
+				key := roomKEY(t, tt.key, signer)
+				sig := &dns.SIG{RRSIG: dns.RRSIG{
+					Algorithm:  key.Algorithm,
+					KeyTag:     key.KeyTag(),
+					SignerName: signer,
+					Inception:  uint32(now.Add(-validity / 2).Unix()),
+					Expiration: uint32(now.Add(validity / 2).Unix()),
+				}}
+				signKey := tt.key
+				if tt.signKey != nil {
+					signKey = tt.signKey
+				}
+				if raw, err = sig.Sign(signKey.PrivateKey, m); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := new(dns.Msg)
+			if err := r.Unpack(raw); err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper != nil {
+				tt.tamper(r)
+			}
+
+			rcode, err := d.applyUpdate(r, raw, z, "192.0.2.1")
+			if tt.replay {
+				if rcode != dns.RcodeSuccess {
+					t.Fatalf("first update: rcode = %s (%v), want NOERROR", dns.RcodeToString[rcode], err)
+				}
+				rcode, err = d.applyUpdate(r, raw, z, "192.0.2.1")
+			}
+			if rcode != tt.wantRcode {
+				t.Errorf("rcode = %s (%v), want %s", dns.RcodeToString[rcode], err, dns.RcodeToString[tt.wantRcode])
+			}
+
+			addresses, _ := d.GetValues("node:" + utils.NodeNameFromID(room, "dev1"))
+			if got := slices.Contains(addresses, "tcp://192.0.2.1:80"); got != tt.wantNode {
+				t.Errorf("node registered = %v, want %v", got, tt.wantNode)
+			}
+		})
+	}
+}
+
+func TestRawUpdatesEvictsOldest(t *testing.T) {
+	u := newRawUpdates()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+
+	update := func(id uint16) []byte {
+		m := new(dns.Msg)
+		m.SetUpdate("example.org.")
+		m.Id = id
+		raw, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	for id := 0; id <= maxRawUpdates; id++ {
+		u.add(remote, update(uint16(id)))
+	}
+
+	tests := []struct {
+		name string
+		id   uint16
+		want bool
+	}{
+		{name: "oldest is evicted", id: 0, want: false},
+		{name: "second oldest is kept", id: 1, want: true},
+		{name: "newest is kept", id: maxRawUpdates, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := u.take(remote, tt.id) != nil; got != tt.want {
+				t.Errorf("update %d kept = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package reqLogic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/i5heu/PathfinderBeacon/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	EventJoin          = "join"
+	EventLeave         = "leave"
+	EventAddressChange = "address-change"
+	EventSync          = "sync"  // first event of a new watch with the current nodes of the room
+	EventReset         = "reset" // the requested event id is no longer known, the client has to re-sync
+)
+
+// RoomEvent is a change of the membership or addresses of a room.
+type RoomEvent struct {
+	ID        uint64   `json:"id"`
+	Type      string   `json:"type"`
+	Room      string   `json:"room"`
+	Node      string   `json:"node,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	Nodes     []string `json:"nodes,omitempty"` // sync only
+	Time      int64    `json:"time"`
+}
+
+// watchHub keeps the last events of all rooms so reconnecting watchers can resume, and fans out new events.
+// Event ids start at the start time of the server in microseconds, so they keep increasing across restarts.
+type watchHub struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []RoomEvent
+	historySize int
+	subscribers map[string]map[chan RoomEvent]struct{}
+
+	// nodes whose addresses expired, the pruner tells the rooms of these nodes
+	changedNodes map[string]struct{}
+}
+
+func newWatchHub(historySize int) *watchHub {
+	return &watchHub{
+		lastID:       uint64(time.Now().UnixMicro()),
+		historySize:  historySize,
+		subscribers:  make(map[string]map[chan RoomEvent]struct{}),
+		changedNodes: make(map[string]struct{}),
+	}
+}
+
+func (h *watchHub) publish(room string, eventType string, node string, addresses []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	event := RoomEvent{
+		ID:        h.lastID,
+		Type:      eventType,
+		Room:      room,
+		Node:      node,
+		Addresses: addresses,
+		Time:      time.Now().Unix(),
+	}
+
+	h.history = append(h.history, event)
+	if len(h.history) > h.historySize {
+		h.history = h.history[len(h.history)-h.historySize:]
+	}
+
+	for ch := range h.subscribers[room] {
+		select {
+		case ch <- event:
+		default:
+			// the watcher is too slow, it has to reconnect and resume from its last event id
+			delete(h.subscribers[room], ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the events of room after lastID and a channel for new events.
+// It reports false if events after lastID are no longer in the history.
+func (h *watchHub) subscribe(room string, lastID uint64) (chan RoomEvent, []RoomEvent, bool, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	complete := lastID >= h.lastID || (len(h.history) > 0 && h.history[0].ID <= lastID+1)
+	if lastID > h.lastID {
+		// an id from the future belongs to another server instance
+		complete = false
+	}
+
+	var backlog []RoomEvent
+	if complete {
+		for _, event := range h.history {
+			if event.ID > lastID && event.Room == room {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	ch := make(chan RoomEvent, 64)
+	if h.subscribers[room] == nil {
+		h.subscribers[room] = make(map[chan RoomEvent]struct{})
+	}
+	h.subscribers[room][ch] = struct{}{}
+
+	return ch, backlog, complete, h.lastID
+}
+
+func (h *watchHub) unsubscribe(room string, ch chan RoomEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[room][ch]; ok {
+		delete(h.subscribers[room], ch)
+		close(ch)
+	}
+	if len(h.subscribers[room]) == 0 {
+		delete(h.subscribers, room)
+	}
+}
+
+func (h *watchHub) markNodeChanged(node string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.changedNodes[node] = struct{}{}
+}
+
+func (h *watchHub) takeChangedNodes() map[string]struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := h.changedNodes
+	h.changedNodes = make(map[string]struct{})
+	return changed
+}
+
+// WatchRoomHandler serves GET /v1/rooms/{room}/watch as Server-Sent Events stream of RoomEvents.
+// Clients resume with the Last-Event-ID header or the lastEventId query parameter,
+// without one, or if the id is too old, they get the current state first.
+func (d *ReqLogic) WatchRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if !d.rateLimitHTTP(w, r) {
+		return
+	}
+
+	room := r.PathValue("room")
+	if !utils.CheckIfSha224(room) {
+		writeJSONError(w, "room is not a valid sha224 hash", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	resume := lastEventID != ""
+	lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+	if resume && err != nil {
+		writeJSONError(w, "invalid last event id", http.StatusBadRequest)
+		return
+	}
+
+	ch, backlog, complete, currentID := d.watch.subscribe(room, lastID)
+	defer d.watch.unsubscribe(room, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+
+	if resume && !complete {
+		d.writeEvent(w, RoomEvent{ID: currentID, Type: EventReset, Room: room, Time: time.Now().Unix()})
+	}
+	if !resume || !complete {
+		members, _ := d.GetValues("room:" + room)
+		d.writeEvent(w, RoomEvent{ID: currentID, Type: EventSync, Room: room, Nodes: members, Time: time.Now().Unix()})
+	}
+	for _, event := range backlog {
+		d.writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			d.writeEvent(w, event)
+			flusher.Flush()
+		}
+	}
+}
+
+func (d *ReqLogic) writeEvent(w http.ResponseWriter, event RoomEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		d.logger.Error("Failed to marshal event", zap.String("room", event.Room), zap.Error(err))
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
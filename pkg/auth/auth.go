@@ -2,6 +2,9 @@ package auth
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -13,50 +16,136 @@ import (
 	"fmt"
 )
 
+// Algorithm is the type of a room key.
+type Algorithm string
+
+const (
+	AlgorithmRSA       Algorithm = "rsa"        // 2048 bit RSA, PKCS#1 v1.5 signatures over SHA-512
+	AlgorithmECDSAP256 Algorithm = "ecdsa-p256" // ECDSA P-256, ASN.1 signatures over SHA-256
+	AlgorithmEd25519   Algorithm = "ed25519"    // Ed25519 signatures over the message itself
+)
+
 type Key struct {
-	PrivateKey *rsa.PrivateKey
+	PrivateKey crypto.Signer
+	Algorithm  Algorithm
 }
 
+// GenerateKey generates a RSA key, use GenerateKeyWithAlgorithm for other key types.
 func GenerateKey() (*Key, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	return GenerateKeyWithAlgorithm(AlgorithmRSA)
+}
+
+func GenerateKeyWithAlgorithm(algorithm Algorithm) (*Key, error) {
+	var privateKey crypto.Signer
+	var err error
+
+	switch algorithm {
+	case AlgorithmRSA:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgorithmECDSAP256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgorithmEd25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("Unsupported algorithm %q", algorithm)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Failed to generate private key: %v", err)
 	}
-	return &Key{PrivateKey: privateKey}, nil
+
+	return &Key{PrivateKey: privateKey, Algorithm: algorithm}, nil
 }
 
+// FromPem loads a private key from a PKCS#1 ("RSA PRIVATE KEY"), SEC 1 ("EC PRIVATE KEY")
+// or PKCS#8 ("PRIVATE KEY") pem block.
 func FromPem(pemBytes []byte) (*Key, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
 		return nil, fmt.Errorf("Failed to decode pem block")
 	}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	var privateKey any
+	var err error
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported pem block type %q", block.Type)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse private key: %v", err)
 	}
 
-	return &Key{PrivateKey: privateKey}, nil
+	return keyFromPrivateKey(privateKey)
+}
+
+func keyFromPrivateKey(privateKey any) (*Key, error) {
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return &Key{PrivateKey: k, Algorithm: AlgorithmRSA}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("Unsupported curve %s", k.Curve.Params().Name)
+		}
+		return &Key{PrivateKey: k, Algorithm: AlgorithmECDSAP256}, nil
+	case ed25519.PrivateKey:
+		return &Key{PrivateKey: k, Algorithm: AlgorithmEd25519}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported private key type %T", privateKey)
+	}
 }
 
 func (a *Key) PrivateKeyToPem() string {
+	if rsaKey, ok := a.PrivateKey.(*rsa.PrivateKey); ok {
+		return string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		}))
+	}
+
+	// can not fail for the key types we create
+	der, _ := x509.MarshalPKCS8PrivateKey(a.PrivateKey)
 	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(a.PrivateKey),
+		Type:  "PRIVATE KEY",
+		Bytes: der,
 	})
 
 	return string(privateKeyPEM)
 }
 
+// PublicKeyToPem encodes RSA keys as PKCS#1 ("RSA PUBLIC KEY") to keep the existing room names,
+// all other keys are encoded as PKIX ("PUBLIC KEY") which includes the key type.
 func (a *Key) PublicKeyToPem() []byte {
-	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: x509.MarshalPKCS1PublicKey(&a.PrivateKey.PublicKey),
-	})
-
+	// can not fail for the key types we create
+	publicKeyPEM, _ := PublicKeyPem(a.PrivateKey.Public())
 	return publicKeyPEM
 }
 
+// PublicKeyPem encodes publicKey like Key.PublicKeyToPem. Rooms of RSA keys sent as PKIX
+// have another name, use RoomNamesFromKey to get all room names of a key.
+func PublicKeyPem(publicKey crypto.PublicKey) ([]byte, error) {
+	if rsaKey, ok := publicKey.(*rsa.PublicKey); ok {
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PUBLIC KEY",
+			Bytes: x509.MarshalPKCS1PublicKey(rsaKey),
+		}), nil
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal public key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}), nil
+}
+
 func (a *Key) PublicKeyToPemBase64() string {
 	return base64.StdEncoding.EncodeToString(a.PublicKeyToPem())
 }
@@ -69,19 +158,129 @@ func (a *Key) GetRoomName() string {
 }
 
 func (a *Key) GetRoomSignature() ([]byte, error) {
-	roomName := a.GetRoomName()
-	roomHash := sha512.Sum512([]byte(roomName))
-
-	signature, err := rsa.SignPKCS1v15(rand.Reader, a.PrivateKey, crypto.SHA512, roomHash[:])
+	signature, err := a.Sign([]byte(a.GetRoomName()))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to sign room name: %v", err)
 	}
 	return signature, nil
 }
 
+// SignPayload signs payload, used for v2 registrations.
+func (a *Key) SignPayload(payload []byte) ([]byte, error) {
+	signature, err := a.Sign(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign payload: %v", err)
+	}
+	return signature, nil
+}
+
+// Sign signs message with the scheme of the key algorithm.
+func (a *Key) Sign(message []byte) ([]byte, error) {
+	switch k := a.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		hash := sha512.Sum512(message)
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA512, hash[:])
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256(message)
+		return ecdsa.SignASN1(rand.Reader, k, hash[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, message), nil
+	default:
+		return nil, fmt.Errorf("Unsupported private key type %T", a.PrivateKey)
+	}
+}
+
+// RoomNameFromPublicKey returns the room name that belongs to the base64 encoded public key pem.
+func RoomNameFromPublicKey(publicKey string) (string, error) {
+	publicKeyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode public key: %v", err)
+	}
+
+	hash := sha256.Sum224(publicKeyBytes)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// RoomNamesFromKey returns the names of the rooms of a parsed public key, e.g. from a DNS KEY record.
+// The room name is the hash of the pem the client sent, an RSA key can be sent as PKCS#1
+// ("RSA PUBLIC KEY", the form of PublicKeyToPem) or PKIX ("PUBLIC KEY"), so it has a room for each.
+func RoomNamesFromKey(publicKey crypto.PublicKey) ([]string, error) {
+	publicKeyPem, err := PublicKeyPem(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	pems := [][]byte{publicKeyPem}
+
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		der, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal public key: %v", err)
+		}
+		pems = append(pems, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+
+	names := make([]string, 0, len(pems))
+	for _, p := range pems {
+		hash := sha256.Sum224(p)
+		names = append(names, hex.EncodeToString(hash[:]))
+	}
+	return names, nil
+}
+
+// NodeNameFromPublicKey returns the node name that belongs to the base64 encoded public key pem of a node key.
+// It is derived like the room name, so any room key can also be used as node key.
+func NodeNameFromPublicKey(publicKey string) (string, error) {
+	return RoomNameFromPublicKey(publicKey)
+}
+
+// ParsePublicKey parses a PKCS#1 ("RSA PUBLIC KEY") or PKIX ("PUBLIC KEY") pem block
+// and detects the algorithm of the key.
+func ParsePublicKey(publicKeyPem []byte) (crypto.PublicKey, Algorithm, error) {
+	block, _ := pem.Decode(publicKeyPem)
+	if block == nil {
+		return nil, "", fmt.Errorf("Failed to decode pem block")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to parse public key: %v", err)
+		}
+		return publicKey, AlgorithmRSA, nil
+	case "PUBLIC KEY":
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to parse public key: %v", err)
+		}
+		switch k := publicKey.(type) {
+		case *rsa.PublicKey:
+			return k, AlgorithmRSA, nil
+		case *ecdsa.PublicKey:
+			if k.Curve != elliptic.P256() {
+				return nil, "", fmt.Errorf("Unsupported curve %s", k.Curve.Params().Name)
+			}
+			return k, AlgorithmECDSAP256, nil
+		case ed25519.PublicKey:
+			return k, AlgorithmEd25519, nil
+		default:
+			return nil, "", fmt.Errorf("Unsupported public key type %T", publicKey)
+		}
+	default:
+		return nil, "", fmt.Errorf("Unsupported pem block type %q", block.Type)
+	}
+}
+
+// VerifyPayloadSignature verifies a signature over payload.
+func VerifyPayloadSignature(payload []byte, signatureBase64 string, publicKey string) (bool, error) {
+	return verifySignature(payload, signatureBase64, publicKey)
+}
+
 func VerifyRoomSignature(roomName string, signatureBase64 string, publicKey string) (bool, error) {
-	roomHash := sha512.Sum512([]byte(roomName))
+	return verifySignature([]byte(roomName), signatureBase64, publicKey)
+}
 
+func verifySignature(message []byte, signatureBase64 string, publicKey string) (bool, error) {
 	// Decode the base64 signature
 	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
 	if err != nil {
@@ -95,20 +294,37 @@ func VerifyRoomSignature(roomName string, signatureBase64 string, publicKey stri
 	}
 
 	// Parse the public key
-	block, _ := pem.Decode(publicKeyBytes)
-	if block == nil {
-		return false, fmt.Errorf("Failed to decode pem block")
-	}
-
-	publicKeyParsed, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	publicKeyParsed, _, err := ParsePublicKey(publicKeyBytes)
 	if err != nil {
-		return false, fmt.Errorf("Failed to parse public key: %v", err)
+		return false, err
 	}
 
 	// Verify the signature using the public key
-	err = rsa.VerifyPKCS1v15(publicKeyParsed, crypto.SHA512, roomHash[:], signature)
+	err = VerifySignature(publicKeyParsed, message, signature)
 	if err != nil {
 		return false, fmt.Errorf("Signature verification failed: %v", err)
 	}
 	return true, nil
 }
+
+// VerifySignature verifies signature over message with the scheme of the public key type.
+func VerifySignature(publicKey crypto.PublicKey, message []byte, signature []byte) error {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		hash := sha512.Sum512(message)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA512, hash[:], signature)
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(message)
+		if !ecdsa.VerifyASN1(k, hash[:], signature) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, message, signature) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unsupported public key type %T", publicKey)
+	}
+}
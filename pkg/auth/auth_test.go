@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"slices"
+	"testing"
+)
+
+func TestRoomNamesFromKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm Algorithm
+		pkix      bool // the client sends the public key as PKIX
+		wantNames int
+	}{
+		{name: "rsa pkcs1", algorithm: AlgorithmRSA, wantNames: 2},
+		{name: "rsa pkix", algorithm: AlgorithmRSA, pkix: true, wantNames: 2},
+		{name: "ecdsa", algorithm: AlgorithmECDSAP256, pkix: true, wantNames: 1},
+		{name: "ed25519", algorithm: AlgorithmEd25519, pkix: true, wantNames: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := GenerateKeyWithAlgorithm(tt.algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			publicKeyPem := key.PublicKeyToPem()
+			if tt.pkix {
+				der, err := x509.MarshalPKIXPublicKey(key.PrivateKey.Public())
+				if err != nil {
+					t.Fatal(err)
+				}
+				publicKeyPem = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+			}
+
+			room, err := RoomNameFromPublicKey(base64.StdEncoding.EncodeToString(publicKeyPem))
+			if err != nil {
+				t.Fatal(err)
+			}
+			publicKey, _, err := ParsePublicKey(publicKeyPem)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names, err := RoomNamesFromKey(publicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(names) != tt.wantNames {
+				t.Errorf("got %d room names, want %d", len(names), tt.wantNames)
+			}
+			if !slices.Contains(names, room) {
+				t.Errorf("room names %v do not contain the room %s of the sent pem", names, room)
+			}
+			if names[0] != key.GetRoomName() {
+				t.Errorf("first room name = %s, want the room of the key %s", names[0], key.GetRoomName())
+			}
+		})
+	}
+}
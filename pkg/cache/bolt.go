@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("entries")
+
+// BoltStore is a Store in a bbolt file on local disk, so the data survives restarts.
+// Every value is prefixed with its expiry as 8 byte unix time, 0 means never.
+// Expired keys are hidden when read and removed every minute.
+type BoltStore struct {
+	db   *bolt.DB
+	hits atomic.Int64
+	stop chan struct{}
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open bolt database %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to create bolt bucket: %v", err)
+	}
+
+	b := &BoltStore{db: db, stop: make(chan struct{})}
+	go b.removeExpired(time.Minute)
+	return b, nil
+}
+
+// decodeBoltValue splits a stored value into its expiry and the value, ok is false if it is expired.
+func decodeBoltValue(raw []byte, now time.Time) (int64, []byte, bool) {
+	if len(raw) < 8 {
+		return 0, nil, false
+	}
+	expires := int64(binary.BigEndian.Uint64(raw))
+	if expires != 0 && expires <= now.Unix() {
+		return 0, nil, false
+	}
+	return expires, raw[8:], true
+}
+
+func (b *BoltStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, v, ok := decodeBoltValue(tx.Bucket(boltBucket).Get(key), time.Now())
+		if !ok {
+			return ErrNotFound
+		}
+		// bolt values are only valid during the transaction
+		value = slices.Clone(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.hits.Add(1)
+	return value, nil
+}
+
+func (b *BoltStore) Set(key []byte, value []byte, ttl int) error {
+	raw := boltRaw(value, ttl, time.Now())
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, raw)
+	})
+}
+
+// boltRaw prefixes value with the expiry of ttl.
+func boltRaw(value []byte, ttl int, now time.Time) []byte {
+	raw := make([]byte, 8+len(value))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(raw, uint64(now.Unix()+int64(ttl)))
+	}
+	copy(raw[8:], value)
+	return raw
+}
+
+// SetBatch writes all keys in one transaction. Concurrent batches are combined by bolt,
+// so they share one fsync.
+func (b *BoltStore) SetBatch(writes []Write) error {
+	now := time.Now()
+	return b.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, w := range writes {
+			if w.Value == nil {
+				if err := bucket.Delete(w.Key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := bucket.Put(w.Key, boltRaw(w.Value, w.TTL, now)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) Del(key []byte) bool {
+	found := false
+	b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		_, _, found = decodeBoltValue(bucket.Get(key), time.Now())
+		return bucket.Delete(key)
+	})
+	return found
+}
+
+func (b *BoltStore) TTL(key []byte) (uint32, error) {
+	var ttl uint32
+	err := b.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		expires, _, ok := decodeBoltValue(tx.Bucket(boltBucket).Get(key), now)
+		if !ok {
+			return ErrNotFound
+		}
+		if expires != 0 {
+			ttl = uint32(expires - now.Unix())
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+func (b *BoltStore) Keys(prefix string) []string {
+	return keysOf(b.Iterate, prefix)
+}
+
+// Iterate calls fn after the read transaction, so fn may write to the store.
+func (b *BoltStore) Iterate(prefix string, fn func(key string, value []byte) bool) {
+	var keys []string
+	var values [][]byte
+
+	b.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		cursor := tx.Bucket(boltBucket).Cursor()
+		for k, raw := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, raw = cursor.Next() {
+			if _, v, ok := decodeBoltValue(raw, now); ok {
+				keys = append(keys, string(k))
+				values = append(values, slices.Clone(v))
+			}
+		}
+		return nil
+	})
+
+	for i, key := range keys {
+		if !fn(key, values[i]) {
+			return
+		}
+	}
+}
+
+func (b *BoltStore) GetStats() CacheStats {
+	return statsOf(b.Iterate, b.hits.Load())
+}
+
+func (b *BoltStore) Close() error {
+	close(b.stop)
+	return b.db.Close()
+}
+
+func (b *BoltStore) removeExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+
+		b.db.Update(func(tx *bolt.Tx) error {
+			now := time.Now()
+			bucket := tx.Bucket(boltBucket)
+
+			// deleting while iterating skips keys, so the expired keys are collected first
+			var expired [][]byte
+			bucket.ForEach(func(k, raw []byte) error {
+				if _, _, ok := decodeBoltValue(raw, now); !ok {
+					expired = append(expired, slices.Clone(k))
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+}
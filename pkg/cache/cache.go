@@ -1,7 +1,6 @@
 package cache
 
 import (
-	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -9,6 +8,9 @@ import (
 	"github.com/coocood/freecache"
 )
 
+// ErrNotFound is returned by Get for missing keys.
+var ErrNotFound = freecache.ErrNotFound
+
 type CacheStats struct {
 	Rooms     uint64
 	Nodes     uint64
@@ -16,6 +18,7 @@ type CacheStats struct {
 	HitCount  int64
 }
 
+// Cache is the Store backend that keeps the data in freecache, it is lost on restart.
 type Cache struct {
 	store  *freecache.Cache
 	Ticker *time.Timer
@@ -57,7 +60,20 @@ func (c *Cache) Get(key []byte) ([]byte, error) {
 	return c.store.Get(key)
 }
 
-func (c *Cache) GetStats() (stats CacheStats) {
+func (c *Cache) Del(key []byte) bool {
+	return c.store.Del(key)
+}
+
+// TTL returns the remaining seconds of key, 0 means the key never expires.
+func (c *Cache) TTL(key []byte) (uint32, error) {
+	return c.store.TTL(key)
+}
+
+func (c *Cache) Keys(prefix string) []string {
+	return keysOf(c.Iterate, prefix)
+}
+
+func (c *Cache) Iterate(prefix string, fn func(key string, value []byte) bool) {
 	iterator := c.store.NewIterator()
 
 	for {
@@ -66,22 +82,18 @@ func (c *Cache) GetStats() (stats CacheStats) {
 			break
 		}
 
-		key := string(next.Key)
-		if strings.HasPrefix(key, "room:") {
-			stats.Rooms++
-		}
-		if strings.HasPrefix(key, "node:") {
-			stats.Nodes++
-
-			// get the addresses for this node
-			var values []string
-			if err := json.Unmarshal(next.Value, &values); err == nil {
-				stats.Addresses += uint64(len(values))
-			}
+		if strings.HasPrefix(string(next.Key), prefix) && !fn(string(next.Key), next.Value) {
+			break
 		}
 	}
+}
 
-	stats.HitCount = c.store.HitCount()
+func (c *Cache) GetStats() CacheStats {
+	return statsOf(c.Iterate, c.store.HitCount())
+}
 
-	return
+// Close stops the daily reset of the statistics, the data is lost.
+func (c *Cache) Close() error {
+	c.Ticker.Stop()
+	return nil
 }
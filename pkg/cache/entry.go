@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Entry is a single value of a key with its own expiry.
+// Expires is a unix timestamp in seconds, 0 means the entry never expires.
+// Updated is the unix time in milliseconds of the last change, used to merge replicated entries.
+type Entry struct {
+	Value   string `json:"value"`
+	Expires int64  `json:"expires"`
+	Updated int64  `json:"updated,omitempty"`
+}
+
+func (e Entry) Expired(now time.Time) bool {
+	return e.Expires != 0 && e.Expires <= now.Unix()
+}
+
+// Remaining returns the seconds until the entry expires, 0 means it never expires.
+func (e Entry) Remaining(now time.Time) uint32 {
+	if e.Expires == 0 {
+		return 0
+	}
+	remaining := e.Expires - now.Unix()
+	if remaining < 1 {
+		return 1
+	}
+	return uint32(remaining)
+}
+
+func DecodeEntries(data []byte) ([]Entry, error) {
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func EncodeEntries(entries []Entry) ([]byte, error) {
+	return json.Marshal(entries)
+}
+
+// PruneEntries returns the entries that are not expired and whether any were removed.
+func PruneEntries(entries []Entry, now time.Time) ([]Entry, bool) {
+	alive := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Expired(now) {
+			alive = append(alive, entry)
+		}
+	}
+	return alive, len(alive) != len(entries)
+}
+
+// KeyTTL returns the TTL the whole key needs to keep all entries alive, 0 means forever.
+func KeyTTL(entries []Entry, now time.Time) int {
+	ttl := 0
+	for _, entry := range entries {
+		if entry.Expires == 0 {
+			return 0
+		}
+		if remaining := int(entry.Remaining(now)); remaining > ttl {
+			ttl = remaining
+		}
+	}
+	return ttl
+}
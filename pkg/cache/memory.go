@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryStore is a Store backed by a map, for tests and small setups. Expired keys are removed when they are read or iterated.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	hits    atomic.Int64
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires int64 // unix seconds, 0 means never
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return e.expires != 0 && e.expires <= now.Unix()
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]memoryEntry)}
+}
+
+// get returns the entry of key, the caller must hold the lock.
+func (m *MemoryStore) get(key string, now time.Time) (memoryEntry, bool) {
+	entry, ok := m.entries[key]
+	if ok && entry.expired(now) {
+		delete(m.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, ok
+}
+
+func (m *MemoryStore) Get(key []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.get(string(key), time.Now())
+	if !ok {
+		return nil, ErrNotFound
+	}
+	m.hits.Add(1)
+	return slices.Clone(entry.value), nil
+}
+
+func (m *MemoryStore) Set(key []byte, value []byte, ttl int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := memoryEntry{value: slices.Clone(value)}
+	if ttl > 0 {
+		entry.expires = time.Now().Unix() + int64(ttl)
+	}
+	m.entries[string(key)] = entry
+	return nil
+}
+
+// SetBatch writes all keys under one lock, so readers see all or none of them.
+func (m *MemoryStore) SetBatch(writes []Write) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, w := range writes {
+		if w.Value == nil {
+			delete(m.entries, string(w.Key))
+			continue
+		}
+		entry := memoryEntry{value: slices.Clone(w.Value)}
+		if w.TTL > 0 {
+			entry.expires = now.Unix() + int64(w.TTL)
+		}
+		m.entries[string(w.Key)] = entry
+	}
+	return nil
+}
+
+func (m *MemoryStore) Del(key []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.get(string(key), time.Now())
+	delete(m.entries, string(key))
+	return ok
+}
+
+func (m *MemoryStore) TTL(key []byte) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := m.get(string(key), now)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if entry.expires == 0 {
+		return 0, nil
+	}
+	return uint32(entry.expires - now.Unix()), nil
+}
+
+func (m *MemoryStore) Keys(prefix string) []string {
+	return keysOf(m.Iterate, prefix)
+}
+
+// Iterate calls fn outside of the lock, so fn may use the store. Expired keys are deleted on the way,
+// the pruner iterates all keys regularly.
+func (m *MemoryStore) Iterate(prefix string, fn func(key string, value []byte) bool) {
+	type item struct {
+		key   string
+		value []byte
+	}
+
+	m.mu.Lock()
+	now := time.Now()
+	var items []item
+	for key, entry := range m.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if entry.expired(now) {
+			delete(m.entries, key)
+			continue
+		}
+		items = append(items, item{key, slices.Clone(entry.value)})
+	}
+	m.mu.Unlock()
+
+	for _, it := range items {
+		if !fn(it.key, it.value) {
+			return
+		}
+	}
+}
+
+func (m *MemoryStore) GetStats() CacheStats {
+	return statsOf(m.Iterate, m.hits.Load())
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
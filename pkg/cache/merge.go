@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"time"
+)
+
+// MergeReplicated merges the entries and tombstones of a key from a peer into the local ones.
+// Tombstones are entries that were removed, they are kept until the removed entry would have expired.
+// For every value the latest change wins, a removal wins over an entry that was updated at the same time.
+// It returns the merged entries and tombstones and whether they differ from the local ones.
+func MergeReplicated(entries, tombstones, remoteEntries, remoteTombstones []Entry, now time.Time) ([]Entry, []Entry, bool) {
+	type candidate struct {
+		entry     Entry
+		tombstone bool
+	}
+
+	newer := func(c candidate, current candidate) bool {
+		switch {
+		case c.entry.Updated != current.entry.Updated:
+			return c.entry.Updated > current.entry.Updated
+		case c.tombstone != current.tombstone:
+			return c.tombstone
+		default:
+			// the same change, keep the longer expiry
+			return current.entry.Expires != 0 && (c.entry.Expires == 0 || c.entry.Expires > current.entry.Expires)
+		}
+	}
+
+	var order []string
+	best := make(map[string]candidate)
+	add := func(list []Entry, tombstone bool) {
+		for _, entry := range list {
+			if entry.Expired(now) {
+				continue
+			}
+			c := candidate{entry: entry, tombstone: tombstone}
+			current, ok := best[entry.Value]
+			if !ok {
+				order = append(order, entry.Value)
+				best[entry.Value] = c
+			} else if newer(c, current) {
+				best[entry.Value] = c
+			}
+		}
+	}
+	add(entries, false)
+	add(tombstones, true)
+	localCount := len(order)
+	add(remoteEntries, false)
+	add(remoteTombstones, true)
+
+	var mergedEntries, mergedTombstones []Entry
+	for _, value := range order {
+		c := best[value]
+		if c.tombstone {
+			mergedTombstones = append(mergedTombstones, c.entry)
+		} else {
+			mergedEntries = append(mergedEntries, c.entry)
+		}
+	}
+
+	changed := len(order) != localCount || !sameEntries(entries, tombstones, mergedEntries, mergedTombstones, now)
+	return mergedEntries, mergedTombstones, changed
+}
+
+// sameEntries reports whether the not expired local entries and tombstones equal the merged ones.
+func sameEntries(entries, tombstones, mergedEntries, mergedTombstones []Entry, now time.Time) bool {
+	entries, _ = PruneEntries(entries, now)
+	tombstones, _ = PruneEntries(tombstones, now)
+	if len(entries) != len(mergedEntries) || len(tombstones) != len(mergedTombstones) {
+		return false
+	}
+
+	seen := make(map[Entry]bool, len(entries)+len(tombstones))
+	for _, entry := range entries {
+		seen[entry] = true
+	}
+	for _, entry := range mergedEntries {
+		if !seen[entry] {
+			return false
+		}
+	}
+
+	seen = make(map[Entry]bool, len(tombstones))
+	for _, entry := range tombstones {
+		seen[entry] = true
+	}
+	for _, entry := range mergedTombstones {
+		if !seen[entry] {
+			return false
+		}
+	}
+	return true
+}
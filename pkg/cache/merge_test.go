@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"cmp"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMergeReplicated(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	later := now.Add(time.Hour).Unix()
+	much := now.Add(2 * time.Hour).Unix()
+
+	tests := []struct {
+		name             string
+		entries          []Entry
+		tombstones       []Entry
+		remoteEntries    []Entry
+		remoteTombstones []Entry
+		wantEntries      []Entry
+		wantTombstones   []Entry
+		wantChanged      bool
+	}{
+		{
+			name:          "new remote entry is added",
+			entries:       []Entry{{Value: "a", Expires: later, Updated: 1}},
+			remoteEntries: []Entry{{Value: "b", Expires: later, Updated: 2}},
+			wantEntries:   []Entry{{Value: "a", Expires: later, Updated: 1}, {Value: "b", Expires: later, Updated: 2}},
+			wantChanged:   true,
+		},
+		{
+			name:          "older remote entry loses",
+			entries:       []Entry{{Value: "a", Expires: much, Updated: 2}},
+			remoteEntries: []Entry{{Value: "a", Expires: later, Updated: 1}},
+			wantEntries:   []Entry{{Value: "a", Expires: much, Updated: 2}},
+		},
+		{
+			name:          "newer remote entry wins",
+			entries:       []Entry{{Value: "a", Expires: later, Updated: 1}},
+			remoteEntries: []Entry{{Value: "a", Expires: much, Updated: 2}},
+			wantEntries:   []Entry{{Value: "a", Expires: much, Updated: 2}},
+			wantChanged:   true,
+		},
+		{
+			name:          "same change keeps the longer expiry",
+			entries:       []Entry{{Value: "a", Expires: later, Updated: 1}},
+			remoteEntries: []Entry{{Value: "a", Expires: much, Updated: 1}},
+			wantEntries:   []Entry{{Value: "a", Expires: much, Updated: 1}},
+			wantChanged:   true,
+		},
+		{
+			name:             "newer remote tombstone removes the entry",
+			entries:          []Entry{{Value: "a", Expires: later, Updated: 1}},
+			remoteTombstones: []Entry{{Value: "a", Expires: later, Updated: 2}},
+			wantTombstones:   []Entry{{Value: "a", Expires: later, Updated: 2}},
+			wantChanged:      true,
+		},
+		{
+			name:             "tombstone wins over an entry of the same time",
+			entries:          []Entry{{Value: "a", Expires: later, Updated: 2}},
+			remoteTombstones: []Entry{{Value: "a", Expires: later, Updated: 2}},
+			wantTombstones:   []Entry{{Value: "a", Expires: later, Updated: 2}},
+			wantChanged:      true,
+		},
+		{
+			name:             "entry that was added again wins over an older tombstone",
+			entries:          []Entry{{Value: "a", Expires: later, Updated: 3}},
+			remoteTombstones: []Entry{{Value: "a", Expires: later, Updated: 2}},
+			wantEntries:      []Entry{{Value: "a", Expires: later, Updated: 3}},
+		},
+		{
+			name:           "local tombstone keeps a stale remote entry out",
+			tombstones:     []Entry{{Value: "a", Expires: later, Updated: 2}},
+			remoteEntries:  []Entry{{Value: "a", Expires: much, Updated: 1}},
+			wantTombstones: []Entry{{Value: "a", Expires: later, Updated: 2}},
+		},
+		{
+			name:          "expired remote entries are ignored",
+			entries:       []Entry{{Value: "a", Expires: later, Updated: 1}},
+			remoteEntries: []Entry{{Value: "b", Expires: now.Unix() - 1, Updated: 2}},
+			wantEntries:   []Entry{{Value: "a", Expires: later, Updated: 1}},
+		},
+		{
+			name:        "expired local entries are dropped",
+			entries:     []Entry{{Value: "a", Expires: now.Unix() - 1, Updated: 1}, {Value: "b", Expires: 0, Updated: 1}},
+			wantEntries: []Entry{{Value: "b", Expires: 0, Updated: 1}},
+		},
+	}
+
+	byValue := func(a, b Entry) int { return cmp.Compare(a.Value, b.Value) }
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, tombstones, changed := MergeReplicated(tt.entries, tt.tombstones, tt.remoteEntries, tt.remoteTombstones, now)
+
+			slices.SortFunc(entries, byValue)
+			slices.SortFunc(tombstones, byValue)
+			if !slices.Equal(entries, tt.wantEntries) {
+				t.Errorf("entries = %v, want %v", entries, tt.wantEntries)
+			}
+			if !slices.Equal(tombstones, tt.wantTombstones) {
+				t.Errorf("tombstones = %v, want %v", tombstones, tt.wantTombstones)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
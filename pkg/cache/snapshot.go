@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotPrefixes are the keys that hold entries, everything else can be rebuilt.
+// Tombstones, signed records and their high-water marks keep removed and replayed registrations
+// from coming back after a restart, meta:serial keeps the SOA serial increasing.
+var snapshotPrefixes = []string{"room:", "node:", "tomb:", "signed:", "highwater:", "meta:"}
+
+// Snapshot is the content of a store at one point in time. The entries keep their absolute
+// expiry, so restoring a snapshot keeps the remaining lifetime of every value.
+type Snapshot struct {
+	Version int             `json:"version"`
+	Created int64           `json:"created"`
+	Keys    []SnapshotEntry `json:"keys"`
+}
+
+type SnapshotEntry struct {
+	Key     string  `json:"key"`
+	Entries []Entry `json:"entries"`
+}
+
+// TakeSnapshot returns the entries of s that are not expired yet.
+func TakeSnapshot(s Store, now time.Time) *Snapshot {
+	snapshot := &Snapshot{Version: 1, Created: now.Unix(), Keys: []SnapshotEntry{}}
+
+	for _, prefix := range snapshotPrefixes {
+		s.Iterate(prefix, func(key string, value []byte) bool {
+			entries, err := DecodeEntries(value)
+			if err != nil {
+				return true
+			}
+			if alive, _ := PruneEntries(entries, now); len(alive) > 0 {
+				snapshot.Keys = append(snapshot.Keys, SnapshotEntry{Key: key, Entries: alive})
+			}
+			return true
+		})
+	}
+
+	return snapshot
+}
+
+// Restore adds the entries of the snapshot to s, expired entries are skipped. Values that already
+// exist in s keep the later expiry. It returns the number of restored keys.
+func (snapshot *Snapshot) Restore(s Store, now time.Time) (int, error) {
+	restored := 0
+	for _, key := range snapshot.Keys {
+		entries, _ := PruneEntries(key.Entries, now)
+		if len(entries) == 0 {
+			continue
+		}
+
+		if data, err := s.Get([]byte(key.Key)); err == nil {
+			if existing, err := DecodeEntries(data); err == nil {
+				existing, _ = PruneEntries(existing, now)
+				entries = MergeEntries(existing, entries)
+			}
+		}
+
+		data, err := EncodeEntries(entries)
+		if err != nil {
+			return restored, err
+		}
+		if err := s.Set([]byte(key.Key), data, KeyTTL(entries, now)); err != nil {
+			return restored, fmt.Errorf("Failed to restore %s: %v", key.Key, err)
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// MergeEntries returns the values of a and b, for values in both the later expiry wins.
+func MergeEntries(a []Entry, b []Entry) []Entry {
+	merged := append([]Entry(nil), a...)
+	for _, entry := range b {
+		found := false
+		for i := range merged {
+			if merged[i].Value != entry.Value {
+				continue
+			}
+			found = true
+			if merged[i].Expires != 0 && (entry.Expires == 0 || entry.Expires > merged[i].Expires) {
+				merged[i].Expires = entry.Expires
+			}
+		}
+		if !found {
+			merged = append(merged, entry)
+		}
+	}
+	return merged
+}
+
+func (snapshot *Snapshot) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("Failed to read snapshot: %v", err)
+	}
+	if snapshot.Version != 1 {
+		return nil, fmt.Errorf("Unsupported snapshot version %d", snapshot.Version)
+	}
+	return &snapshot, nil
+}
+
+// SaveSnapshot writes the snapshot of s to path. It is written to a temporary file first,
+// so a crash while writing never leaves a broken snapshot behind.
+func SaveSnapshot(s Store, path string) (int, error) {
+	snapshot := TakeSnapshot(s, time.Now())
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create snapshot file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	if err := snapshot.Write(file); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("Failed to write snapshot: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("Failed to write snapshot: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("Failed to write snapshot: %v", err)
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return 0, fmt.Errorf("Failed to replace snapshot: %v", err)
+	}
+	return len(snapshot.Keys), nil
+}
+
+// LoadSnapshot restores the snapshot at path into s, a missing file restores nothing.
+func LoadSnapshot(s Store, path string) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open snapshot: %v", err)
+	}
+	defer file.Close()
+
+	snapshot, err := ReadSnapshot(file)
+	if err != nil {
+		return 0, err
+	}
+	return snapshot.Restore(s, time.Now())
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Store is the storage of the beacon data, keys map to encoded entries with a TTL for the whole key.
+// The freecache Cache keeps everything in memory, BoltStore on disk and MemoryStore is a simple map.
+type Store interface {
+	// Get returns the value of key or ErrNotFound if it is missing or expired.
+	Get(key []byte) ([]byte, error)
+	// Set stores value for ttl seconds, a ttl of 0 means the key never expires.
+	Set(key []byte, value []byte, ttl int) error
+	// Del deletes key and reports whether it existed.
+	Del(key []byte) bool
+	// TTL returns the remaining seconds of key, 0 means the key never expires.
+	TTL(key []byte) (uint32, error)
+	// Keys returns all keys with the given prefix.
+	Keys(prefix string) []string
+	// Iterate calls fn for every key with the given prefix until fn returns false.
+	Iterate(prefix string, fn func(key string, value []byte) bool)
+	GetStats() CacheStats
+	Close() error
+}
+
+// Write is one key of a batch, a nil value deletes the key.
+type Write struct {
+	Key   []byte
+	Value []byte
+	TTL   int
+}
+
+// Batcher is implemented by stores that can write several keys at once, BoltStore writes them in one transaction.
+type Batcher interface {
+	SetBatch(writes []Write) error
+}
+
+// WriteBatch writes all writes to s, at once if s is a Batcher and one by one otherwise.
+func WriteBatch(s Store, writes []Write) error {
+	if batcher, ok := s.(Batcher); ok {
+		return batcher.SetBatch(writes)
+	}
+
+	for _, w := range writes {
+		if w.Value == nil {
+			s.Del(w.Key)
+			continue
+		}
+		if err := s.Set(w.Key, w.Value, w.TTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	BackendFreecache = "freecache"
+	BackendBolt      = "bolt"
+	BackendMemory    = "memory"
+)
+
+// NewStore creates the store of the given backend, sizeMB is used by freecache and path by bolt.
+func NewStore(backend string, sizeMB int, path string) (Store, error) {
+	switch backend {
+	case BackendFreecache:
+		return NewCache(sizeMB * 1024 * 1024), nil
+	case BackendBolt:
+		return NewBoltStore(path)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("Unknown cache backend %q", backend)
+	}
+}
+
+// keysOf collects the keys of iterate, shared by the backends.
+func keysOf(iterate func(prefix string, fn func(key string, value []byte) bool), prefix string) []string {
+	var keys []string
+	iterate(prefix, func(key string, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// statsOf counts the rooms, nodes and addresses that are not expired yet.
+func statsOf(iterate func(prefix string, fn func(key string, value []byte) bool), hitCount int64) (stats CacheStats) {
+	now := time.Now()
+	iterate("", func(key string, value []byte) bool {
+		if strings.HasPrefix(key, "room:") {
+			stats.Rooms++
+		}
+		if strings.HasPrefix(key, "node:") {
+			stats.Nodes++
+
+			if entries, err := DecodeEntries(value); err == nil {
+				alive, _ := PruneEntries(entries, now)
+				stats.Addresses += uint64(len(alive))
+			}
+		}
+		return true
+	})
+
+	stats.HitCount = hitCount
+	return
+}
@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// storeBackends opens an empty store of every backend.
+var storeBackends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{name: BackendFreecache, open: func(t *testing.T) Store { return NewCache(1024 * 1024) }},
+	{name: BackendBolt, open: func(t *testing.T) Store {
+		s, err := NewBoltStore(filepath.Join(t.TempDir(), "store.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+	{name: BackendMemory, open: func(t *testing.T) Store { return NewMemoryStore() }},
+}
+
+func TestStoreContract(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{name: "get and set", run: func(t *testing.T, s Store) {
+			if _, err := s.Get([]byte("room:a")); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Get of a missing key: err = %v, want ErrNotFound", err)
+			}
+			if err := s.Set([]byte("room:a"), []byte("one"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Set([]byte("room:a"), []byte("two"), 0); err != nil {
+				t.Fatal(err)
+			}
+			value, err := s.Get([]byte("room:a"))
+			if err != nil || string(value) != "two" {
+				t.Fatalf("Get = %q, %v, want %q", value, err, "two")
+			}
+		}},
+		{name: "del", run: func(t *testing.T, s Store) {
+			s.Set([]byte("room:a"), []byte("one"), 0)
+			if !s.Del([]byte("room:a")) {
+				t.Errorf("Del of an existing key = false")
+			}
+			if s.Del([]byte("room:a")) {
+				t.Errorf("Del of a deleted key = true")
+			}
+			if _, err := s.Get([]byte("room:a")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a deleted key: err = %v, want ErrNotFound", err)
+			}
+		}},
+		{name: "ttl", run: func(t *testing.T, s Store) {
+			s.Set([]byte("room:forever"), []byte("one"), 0)
+			s.Set([]byte("room:hour"), []byte("one"), 3600)
+
+			if ttl, err := s.TTL([]byte("room:forever")); err != nil || ttl != 0 {
+				t.Errorf("TTL of a key without expiry = %d, %v, want 0", ttl, err)
+			}
+			if ttl, err := s.TTL([]byte("room:hour")); err != nil || ttl < 3599 || ttl > 3600 {
+				t.Errorf("TTL = %d, %v, want 3600", ttl, err)
+			}
+			if _, err := s.TTL([]byte("room:missing")); err == nil {
+				t.Errorf("TTL of a missing key: err = nil")
+			}
+		}},
+		{name: "keys and iterate by prefix", run: func(t *testing.T, s Store) {
+			for _, key := range []string{"room:a", "room:b", "node:a", "tomb:room:a"} {
+				s.Set([]byte(key), []byte(key), 0)
+			}
+
+			keys := s.Keys("room:")
+			slices.Sort(keys)
+			if !slices.Equal(keys, []string{"room:a", "room:b"}) {
+				t.Errorf("Keys = %v, want [room:a room:b]", keys)
+			}
+			if keys := s.Keys(""); len(keys) != 4 {
+				t.Errorf("Keys of all = %v, want 4 keys", keys)
+			}
+
+			values := make(map[string]string)
+			s.Iterate("node:", func(key string, value []byte) bool {
+				values[key] = string(value)
+				return true
+			})
+			if len(values) != 1 || values["node:a"] != "node:a" {
+				t.Errorf("Iterate = %v, want node:a", values)
+			}
+
+			calls := 0
+			s.Iterate("", func(string, []byte) bool {
+				calls++
+				return false
+			})
+			if calls != 1 {
+				t.Errorf("Iterate called fn %d times after it returned false, want 1", calls)
+			}
+		}},
+		{name: "write batch", run: func(t *testing.T, s Store) {
+			s.Set([]byte("room:old"), []byte("old"), 0)
+
+			err := WriteBatch(s, []Write{
+				{Key: []byte("room:a"), Value: []byte("one"), TTL: 0},
+				{Key: []byte("node:a"), Value: []byte("two"), TTL: 3600},
+				{Key: []byte("room:old")},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if value, err := s.Get([]byte("room:a")); err != nil || string(value) != "one" {
+				t.Errorf("Get room:a = %q, %v, want %q", value, err, "one")
+			}
+			if ttl, err := s.TTL([]byte("node:a")); err != nil || ttl < 3599 || ttl > 3600 {
+				t.Errorf("TTL of node:a = %d, %v, want 3600", ttl, err)
+			}
+			if _, err := s.Get([]byte("room:old")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a key deleted by the batch: err = %v, want ErrNotFound", err)
+			}
+		}},
+		{name: "expiry", run: func(t *testing.T, s Store) {
+			s.Set([]byte("room:short"), []byte("one"), 1)
+			s.Set([]byte("room:long"), []byte("two"), 3600)
+
+			time.Sleep(2100 * time.Millisecond)
+
+			if _, err := s.Get([]byte("room:short")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of an expired key: err = %v, want ErrNotFound", err)
+			}
+			if _, err := s.TTL([]byte("room:short")); err == nil {
+				t.Errorf("TTL of an expired key: err = nil")
+			}
+			if keys := s.Keys("room:"); !slices.Equal(keys, []string{"room:long"}) {
+				t.Errorf("Keys = %v, want [room:long]", keys)
+			}
+		}},
+	}
+
+	for _, backend := range storeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			t.Parallel()
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					s := backend.open(t)
+					defer s.Close()
+					tt.run(t, s)
+				})
+			}
+		})
+	}
+}
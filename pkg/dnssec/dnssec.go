@@ -0,0 +1,373 @@
+package dnssec
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var algorithms = map[string]uint8{
+	"ecdsa-p256": dns.ECDSAP256SHA256,
+	"ed25519":    dns.ED25519,
+}
+
+// Signer signs the RRsets of one zone online with a key signing key (KSK) and a zone signing key (ZSK).
+// The KSK signs the DNSKEY RRset, the ZSK everything else. Both can be the same key (CSK).
+type Signer struct {
+	zone     string
+	ksk      *dns.DNSKEY
+	kskPriv  crypto.Signer
+	zsk      *dns.DNSKEY
+	zskPriv  crypto.Signer
+	validity time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedSignature
+}
+
+type cachedSignature struct {
+	sig     *dns.RRSIG
+	expires time.Time
+}
+
+// NewSigner loads the KSK and ZSK from BIND style key files, kskPath and zskPath are the file names
+// without the .key and .private extension. The signatures are valid for validity.
+func NewSigner(zone string, kskPath string, zskPath string, validity time.Duration) (*Signer, error) {
+	zone = dns.CanonicalName(zone)
+
+	ksk, kskPriv, err := LoadKey(kskPath)
+	if err != nil {
+		return nil, err
+	}
+	zsk, zskPriv, err := LoadKey(zskPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// every RRset is only signed by one of the keys, so both have to use the same algorithm (RFC 6840 5.11)
+	if ksk.Algorithm != zsk.Algorithm {
+		return nil, fmt.Errorf("KSK and ZSK use different algorithms")
+	}
+	for _, key := range []*dns.DNSKEY{ksk, zsk} {
+		if dns.CanonicalName(key.Hdr.Name) != zone {
+			return nil, fmt.Errorf("Key %d is for %s and not for %s", key.KeyTag(), key.Hdr.Name, zone)
+		}
+	}
+
+	return &Signer{
+		zone:     zone,
+		ksk:      ksk,
+		kskPriv:  kskPriv,
+		zsk:      zsk,
+		zskPriv:  zskPriv,
+		validity: validity,
+		cache:    make(map[string]cachedSignature),
+	}, nil
+}
+
+// LoadKey reads path.key and path.private.
+func LoadKey(path string) (*dns.DNSKEY, crypto.Signer, error) {
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".key"), ".private")
+
+	pub, err := os.ReadFile(path + ".key")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read public key: %v", err)
+	}
+	rr, err := dns.NewRR(string(pub))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse public key %s.key: %v", path, err)
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s.key does not contain a DNSKEY", path)
+	}
+
+	privFile, err := os.Open(path + ".private")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read private key: %v", err)
+	}
+	defer privFile.Close()
+
+	priv, err := key.ReadPrivateKey(privFile, path+".private")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse private key %s.private: %v", path, err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("Unsupported private key in %s.private", path)
+	}
+
+	return key, signer, nil
+}
+
+// GenerateKey creates a new key for zone and writes it as BIND style key files to dir.
+// algorithm is "ecdsa-p256" or "ed25519", ksk selects the SEP flag. It returns the path without extension.
+func GenerateKey(zone string, algorithm string, ksk bool, dir string) (string, error) {
+	alg, ok := algorithms[algorithm]
+	if !ok {
+		return "", fmt.Errorf("Unsupported algorithm %q, use ecdsa-p256 or ed25519", algorithm)
+	}
+
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   dns.CanonicalName(zone),
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: alg,
+	}
+	if ksk {
+		key.Flags |= dns.SEP
+	}
+
+	bits := 256
+	priv, err := key.Generate(bits)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate key: %v", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", key.Hdr.Name, key.Algorithm, key.KeyTag()))
+	if err := os.WriteFile(path+".key", []byte(key.String()+"\n"), 0644); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path+".private", []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (s *Signer) Zone() string {
+	return s.zone
+}
+
+// DNSKEYs returns the DNSKEY RRset of the zone.
+func (s *Signer) DNSKEYs(ttl uint32) []dns.RR {
+	keys := []dns.RR{s.withTTL(s.ksk, ttl)}
+	if s.zsk.KeyTag() != s.ksk.KeyTag() {
+		keys = append(keys, s.withTTL(s.zsk, ttl))
+	}
+	return keys
+}
+
+func (s *Signer) withTTL(key *dns.DNSKEY, ttl uint32) *dns.DNSKEY {
+	k := dns.Copy(key).(*dns.DNSKEY)
+	k.Hdr.Ttl = ttl
+	return k
+}
+
+// DS returns the DS record of the KSK for the parent zone.
+func (s *Signer) DS(digest uint8) *dns.DS {
+	return s.ksk.ToDS(digest)
+}
+
+// Sign signs each RRset in records and returns the records followed by their signatures.
+// The TTLs of an RRset are set to the lowest TTL of the set, as required for signing (RFC 2181 5.2).
+// OPT, existing RRSIG records and records outside of the zone are returned unsigned.
+func (s *Signer) Sign(records []dns.RR, now time.Time) ([]dns.RR, error) {
+	var signed []dns.RR
+
+	for _, rrset := range splitRRsets(records) {
+		signed = append(signed, rrset...)
+
+		rrtype := rrset[0].Header().Rrtype
+		if rrtype == dns.TypeOPT || rrtype == dns.TypeRRSIG || !dns.IsSubDomain(s.zone, dns.CanonicalName(rrset[0].Header().Name)) {
+			continue
+		}
+
+		sig, err := s.signRRset(rrset, now)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, sig)
+	}
+
+	return signed, nil
+}
+
+func (s *Signer) signRRset(rrset []dns.RR, now time.Time) (*dns.RRSIG, error) {
+	key, priv := s.zsk, s.zskPriv
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key, priv = s.ksk, s.kskPriv
+	}
+
+	// round the inception, so the same RRset gets the same signature for an hour
+	inception := now.Truncate(time.Hour).Add(-time.Hour)
+	cacheKey := strconv.FormatInt(inception.Unix(), 10) + "\n" + rrsetKey(rrset)
+
+	s.mu.Lock()
+	cached, ok := s.cache[cacheKey]
+	s.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		// the TTL is not part of the key, it counts down for dynamic records
+		sig := dns.Copy(cached.sig).(*dns.RRSIG)
+		sig.Hdr.Ttl = rrset[0].Header().Ttl
+		return sig, nil
+	}
+
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: rrset[0].Header().Ttl,
+		},
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(inception.Add(s.validity).Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: s.zone,
+	}
+	if err := sig.Sign(priv, rrset); err != nil {
+		return nil, fmt.Errorf("Failed to sign %s %s: %v", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype], err)
+	}
+
+	s.mu.Lock()
+	if len(s.cache) > 10000 {
+		s.cache = make(map[string]cachedSignature)
+	}
+	s.cache[cacheKey] = cachedSignature{sig: sig, expires: inception.Add(2 * time.Hour)}
+	s.mu.Unlock()
+
+	return dns.Copy(sig).(*dns.RRSIG), nil
+}
+
+// splitRRsets groups records by owner, class and type in the order they first appear
+// and sets the TTL of each set to its lowest TTL.
+func splitRRsets(records []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := make(map[string]int)
+
+	for _, rr := range records {
+		hdr := rr.Header()
+		key := fmt.Sprintf("%s/%d/%d", dns.CanonicalName(hdr.Name), hdr.Class, hdr.Rrtype)
+		if hdr.Rrtype == dns.TypeRRSIG {
+			key += "/" + dns.TypeToString[rr.(*dns.RRSIG).TypeCovered]
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(sets)
+			index[key] = i
+			sets = append(sets, nil)
+		}
+		sets[i] = append(sets[i], rr)
+	}
+
+	for _, set := range sets {
+		minTTL := set[0].Header().Ttl
+		for _, rr := range set {
+			minTTL = min(minTTL, rr.Header().Ttl)
+		}
+		for _, rr := range set {
+			rr.Header().Ttl = minTTL
+		}
+	}
+
+	return sets
+}
+
+// rrsetKey returns the records of rrset without their TTL, which changes with every answer of dynamic records.
+func rrsetKey(rrset []dns.RR) string {
+	var b strings.Builder
+	for _, rr := range rrset {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		b.WriteString(rr.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// DenialOfExistence returns a "black lies" NSEC record (RFC 4470 minimally covering, as used by
+// online signers) that proves qType does not exist at qName. The next name is the direct
+// successor of qName, so NXDOMAIN answers become NODATA answers and nothing else is denied.
+// types are the types that may exist at qName, they are kept in the bitmap.
+func DenialOfExistence(qName string, qType uint16, types []uint16, ttl uint32) *dns.NSEC {
+	bitmap := []uint16{dns.TypeNSEC, dns.TypeRRSIG}
+	for _, t := range types {
+		if t != qType {
+			bitmap = append(bitmap, t)
+		}
+	}
+
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   dns.CanonicalName(qName),
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		NextDomain: "\\000." + dns.CanonicalName(qName),
+		TypeBitMap: sortTypes(bitmap),
+	}
+}
+
+func sortTypes(types []uint16) []uint16 {
+	slices.Sort(types)
+	return slices.Compact(types)
+}
+
+// PublicKey decodes the public key of a DNSKEY or KEY record (RFC 3110, RFC 6605 and RFC 8080).
+func PublicKey(key *dns.DNSKEY) (crypto.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode public key: %v", err)
+	}
+
+	switch key.Algorithm {
+	case dns.RSASHA1, dns.RSASHA256, dns.RSASHA512:
+		// exponent length, exponent and modulus
+		if len(raw) < 3 {
+			return nil, fmt.Errorf("RSA public key is too short")
+		}
+		explen, offset := int(raw[0]), 1
+		if explen == 0 {
+			explen, offset = int(raw[1])<<8|int(raw[2]), 3
+		}
+		if explen == 0 || explen > 4 || len(raw) <= offset+explen {
+			return nil, fmt.Errorf("Invalid RSA public key")
+		}
+
+		exponent := 0
+		for _, b := range raw[offset : offset+explen] {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(raw[offset+explen:]), E: exponent}, nil
+	case dns.ECDSAP256SHA256:
+		if len(raw) != 64 {
+			return nil, fmt.Errorf("ECDSA P-256 public key must be 64 bytes")
+		}
+		// the key comes from the network, points off the curve are rejected here
+		if _, err := ecdh.P256().NewPublicKey(append([]byte{4}, raw...)); err != nil {
+			return nil, fmt.Errorf("ECDSA P-256 public key is not on the curve")
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(raw[:32]),
+			Y:     new(big.Int).SetBytes(raw[32:]),
+		}, nil
+	case dns.ED25519:
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Ed25519 public key must be %d bytes", ed25519.PublicKeySize)
+		}
+		return ed25519.PublicKey(raw), nil
+	default:
+		return nil, fmt.Errorf("Unsupported key algorithm %s", dns.AlgorithmToString[key.Algorithm])
+	}
+}
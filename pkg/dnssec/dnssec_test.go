@@ -0,0 +1,175 @@
+package dnssec
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newKey returns a new KEY of algorithm and its private key.
+func newKey(t *testing.T, algorithm uint8, bits int) (*dns.DNSKEY, crypto.Signer) {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "room.example.org.", Rrtype: dns.TypeKEY, Class: dns.ClassINET},
+		Flags:     0x200,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+	priv, err := key.Generate(bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, priv.(crypto.Signer)
+}
+
+func TestPublicKey(t *testing.T) {
+	rsaKey, rsaPriv := newKey(t, dns.RSASHA256, 2048)
+	ecdsaKey, ecdsaPriv := newKey(t, dns.ECDSAP256SHA256, 256)
+	ed25519Key, ed25519Priv := newKey(t, dns.ED25519, 256)
+
+	// RFC 3110 allows a three byte exponent length, which dns.DNSKEY.Generate never uses
+	rsaPub := rsaPriv.Public().(*rsa.PublicKey)
+	e := big.NewInt(int64(rsaPub.E)).Bytes()
+	longExponent := append([]byte{0, 0, byte(len(e))}, e...)
+	longExponent = append(longExponent, rsaPub.N.Bytes()...)
+
+	tests := []struct {
+		name      string
+		algorithm uint8
+		publicKey string
+		want      crypto.PublicKey // nil if the key is invalid
+	}{
+		{name: "rsa", algorithm: rsaKey.Algorithm, publicKey: rsaKey.PublicKey, want: rsaPub},
+		{name: "rsa with long exponent length", algorithm: dns.RSASHA512, publicKey: base64.StdEncoding.EncodeToString(longExponent), want: rsaPub},
+		{name: "ecdsa", algorithm: ecdsaKey.Algorithm, publicKey: ecdsaKey.PublicKey, want: ecdsaPriv.Public()},
+		{name: "ed25519", algorithm: ed25519Key.Algorithm, publicKey: ed25519Key.PublicKey, want: ed25519Priv.Public()},
+		{name: "invalid base64", algorithm: dns.ED25519, publicKey: "not base64!"},
+		{name: "short rsa", algorithm: dns.RSASHA256, publicKey: base64.StdEncoding.EncodeToString([]byte{1, 3})},
+		{name: "rsa without modulus", algorithm: dns.RSASHA256, publicKey: base64.StdEncoding.EncodeToString([]byte{3, 1, 0, 1})},
+		{name: "short ecdsa", algorithm: dns.ECDSAP256SHA256, publicKey: base64.StdEncoding.EncodeToString(make([]byte, 32))},
+		{name: "ecdsa point off the curve", algorithm: dns.ECDSAP256SHA256, publicKey: base64.StdEncoding.EncodeToString(make([]byte, 64))},
+		{name: "short ed25519", algorithm: dns.ED25519, publicKey: base64.StdEncoding.EncodeToString(make([]byte, 31))},
+		{name: "unsupported algorithm", algorithm: dns.ECDSAP384SHA384, publicKey: ecdsaKey.PublicKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PublicKey(&dns.DNSKEY{Algorithm: tt.algorithm, PublicKey: tt.publicKey})
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("PublicKey = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want.(interface{ Equal(crypto.PublicKey) bool }).Equal(got) {
+				t.Errorf("PublicKey = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignerSign(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		algorithm string
+		records   []string
+		wantSigs  int // besides the signature of the DNSKEY RRset
+	}{
+		{
+			name:      "ecdsa",
+			algorithm: "ecdsa-p256",
+			records:   []string{"www.example.org. 300 IN A 192.0.2.1", "www.example.org. 60 IN A 192.0.2.2"},
+			wantSigs:  1,
+		},
+		{
+			name:      "ed25519",
+			algorithm: "ed25519",
+			records:   []string{"www.example.org. 300 IN A 192.0.2.1", "www.example.org. 300 IN AAAA 2001:db8::1"},
+			wantSigs:  2,
+		},
+		{
+			name:      "records outside of the zone",
+			algorithm: "ed25519",
+			records:   []string{"www.example.com. 300 IN A 192.0.2.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ksk, err := GenerateKey("example.org.", tt.algorithm, true, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zsk, err := GenerateKey("example.org.", tt.algorithm, false, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := NewSigner("example.org.", ksk, zsk, 7*24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var records []dns.RR
+			for _, record := range tt.records {
+				rr, err := dns.NewRR(record)
+				if err != nil {
+					t.Fatal(err)
+				}
+				records = append(records, rr)
+			}
+			records = append(records, s.DNSKEYs(3600)...)
+
+			signed, err := s.Sign(records, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := make(map[uint16]*dns.DNSKEY)
+			for _, rr := range s.DNSKEYs(3600) {
+				key := rr.(*dns.DNSKEY)
+				keys[key.KeyTag()] = key
+			}
+
+			sigs := 0
+			for _, rr := range signed {
+				sig, ok := rr.(*dns.RRSIG)
+				if !ok {
+					continue
+				}
+				sigs++
+
+				var rrset []dns.RR
+				for _, rr := range signed {
+					if rr.Header().Rrtype == sig.TypeCovered && rr.Header().Name == sig.Hdr.Name {
+						rrset = append(rrset, rr)
+					}
+				}
+				key := keys[sig.KeyTag]
+				if err := sig.Verify(key, rrset); err != nil {
+					t.Errorf("signature of %s %s: %v", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered], err)
+				}
+				if !sig.ValidityPeriod(now) {
+					t.Errorf("signature of %s %s is not valid now", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+				}
+				if wantSEP := sig.TypeCovered == dns.TypeDNSKEY; (key.Flags&dns.SEP != 0) != wantSEP {
+					t.Errorf("%s %s is signed by key %d with flags %d", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered], key.KeyTag(), key.Flags)
+				}
+			}
+			if sigs != tt.wantSigs+1 {
+				t.Errorf("got %d signatures, want %d", sigs, tt.wantSigs+1)
+			}
+		})
+	}
+}
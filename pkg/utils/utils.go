@@ -1,6 +1,12 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -11,10 +17,98 @@ type RegisteringAddress struct {
 }
 
 type RegisteringNode struct {
+	Version       int                  `json:"version,omitempty"` // 0 or 1 for the legacy format, 2 for signed payloads
 	Room          string               `json:"room"`
 	RoomSignature string               `json:"roomSignature"` // base64 encoded
 	PublicKey     string               `json:"publicKey"`     // base64 encoded
 	Addresses     []RegisteringAddress `json:"addresses"`
+	Timestamp     int64                `json:"timestamp,omitempty"`     // unix seconds, v2 only
+	Nonce         string               `json:"nonce,omitempty"`         // v2 only
+	Node          string               `json:"node,omitempty"`          // stable node id chosen by the client, v2 only
+	NodePublicKey string               `json:"nodePublicKey,omitempty"` // base64 encoded, optional proof of the node name
+	NodeSignature string               `json:"nodeSignature,omitempty"` // base64 encoded signature of the node key over the canonical payload
+	Expires       int64                `json:"expires,omitempty"`       // unix seconds, optional end of the lifetime signed by the room, v2 only
+}
+
+const (
+	ActionRegister   = "register"
+	ActionDeregister = "deregister"
+)
+
+// registrationPayload is the part of a v2 registration that is covered by the room signature.
+// The field order is part of the format, do not reorder.
+type registrationPayload struct {
+	Action    string               `json:"action"`
+	Room      string               `json:"room"`
+	Addresses []RegisteringAddress `json:"addresses"`
+	Timestamp int64                `json:"timestamp"`
+	Nonce     string               `json:"nonce"`
+	Node      string               `json:"node,omitempty"`
+	Expires   int64                `json:"expires,omitempty"`
+}
+
+// CanonicalPayload returns the bytes a v2 roomSignature is created over:
+// compact JSON of action, room, addresses, timestamp, nonce, node and expires (if set) in this order.
+// <, > and & are not escaped, so signers in other languages get the same bytes.
+func (r RegisteringNode) CanonicalPayload(action string) ([]byte, error) {
+	addresses := r.Addresses
+	if addresses == nil {
+		addresses = []RegisteringAddress{}
+	}
+
+	var payload bytes.Buffer
+	encoder := json.NewEncoder(&payload)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(registrationPayload{
+		Action:    action,
+		Room:      r.Room,
+		Addresses: addresses,
+		Timestamp: r.Timestamp,
+		Nonce:     r.Nonce,
+		Node:      r.Node,
+		Expires:   r.Expires,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(payload.Bytes(), []byte("\n")), nil
+}
+
+// FormatAddress returns the address in the stored form, e.g. "tcp://1.2.3.4:80".
+func FormatAddress(addr RegisteringAddress) string {
+	return fmt.Sprintf("%s://%s:%d", addr.Protocol, addr.Ip, addr.Port)
+}
+
+// ParseAddress parses an address in the form returned by FormatAddress.
+func ParseAddress(s string) (RegisteringAddress, error) {
+	protocol, hostPort, ok := strings.Cut(s, "://")
+	if !ok {
+		return RegisteringAddress{}, fmt.Errorf("address has no protocol: %s", s)
+	}
+
+	// IPv6 addresses are stored without brackets, so the port is after the last colon
+	i := strings.LastIndex(hostPort, ":")
+	if i < 0 {
+		return RegisteringAddress{}, fmt.Errorf("address has no port: %s", s)
+	}
+
+	port, err := strconv.Atoi(hostPort[i+1:])
+	if err != nil {
+		return RegisteringAddress{}, fmt.Errorf("address has an invalid port: %s", s)
+	}
+
+	return RegisteringAddress{
+		Protocol: protocol,
+		Ip:       hostPort[:i],
+		Port:     port,
+	}, nil
+}
+
+// NodeNameFromID returns the node name for a node id chosen by the client.
+// The id is scoped to the room, so other rooms can not write to the same node.
+func NodeNameFromID(room string, id string) string {
+	nodeName := sha512.Sum512_224([]byte("node:" + room + ":" + id))
+	return hex.EncodeToString(nodeName[:])
 }
 
 func ToLowerCase(s string) string {
@@ -47,13 +141,20 @@ func CheckIfSha224(name string) bool {
 	return true
 }
 
-func GetDNSParameterAndCheckIfSha224(qName string) (string, bool) {
-	// get the first part of the domain name
-	parts := strings.Split(qName, ".")
-	if len(parts) != 5 {
+// GetDNSParameterAndCheckIfSha224 returns the label directly in front of suffix
+// (e.g. "room.pathfinderbeacon.net.") if it is a valid sha224 hash.
+func GetDNSParameterAndCheckIfSha224(qName string, suffix string) (string, bool) {
+	qName = ToLowerCase(qName)
+	suffix = ToLowerCase(suffix)
+
+	if !strings.HasSuffix(qName, "."+suffix) {
+		return "", false
+	}
+
+	name := strings.TrimSuffix(qName, "."+suffix)
+	if strings.Contains(name, ".") {
 		return "", false
 	}
-	name := parts[0]
 
 	if !CheckIfSha224(name) {
 		return "", false
@@ -0,0 +1,51 @@
+package utils
+
+import "testing"
+
+func TestCanonicalPayload(t *testing.T) {
+	addresses := []RegisteringAddress{{Protocol: "tcp", Ip: "192.0.2.1", Port: 80}}
+
+	tests := []struct {
+		name   string
+		action string
+		node   RegisteringNode
+		want   string
+	}{
+		{
+			name:   "required fields",
+			action: ActionRegister,
+			node:   RegisteringNode{Room: "room", Addresses: addresses, Timestamp: 1718000000, Nonce: "0123456789abcdef"},
+			want:   `{"action":"register","room":"room","addresses":[{"protocol":"tcp","ip":"192.0.2.1","port":80}],"timestamp":1718000000,"nonce":"0123456789abcdef"}`,
+		},
+		{
+			name:   "node and expires are appended",
+			action: ActionRegister,
+			node:   RegisteringNode{Room: "room", Addresses: addresses, Timestamp: 1718000000, Nonce: "0123456789abcdef", Node: "dev1", Expires: 1718003600},
+			want:   `{"action":"register","room":"room","addresses":[{"protocol":"tcp","ip":"192.0.2.1","port":80}],"timestamp":1718000000,"nonce":"0123456789abcdef","node":"dev1","expires":1718003600}`,
+		},
+		{
+			name:   "deregistration without addresses",
+			action: ActionDeregister,
+			node:   RegisteringNode{Room: "room", Timestamp: 1718000000, Nonce: "0123456789abcdef"},
+			want:   `{"action":"deregister","room":"room","addresses":[],"timestamp":1718000000,"nonce":"0123456789abcdef"}`,
+		},
+		{
+			name:   "html characters are not escaped",
+			action: ActionRegister,
+			node:   RegisteringNode{Room: "room", Addresses: addresses, Timestamp: 1718000000, Nonce: "<a&b>0123456789", Node: `"dev"`},
+			want:   `{"action":"register","room":"room","addresses":[{"protocol":"tcp","ip":"192.0.2.1","port":80}],"timestamp":1718000000,"nonce":"<a&b>0123456789","node":"\"dev\""}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.node.CanonicalPayload(tt.action)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("payload =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
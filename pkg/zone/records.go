@@ -0,0 +1,174 @@
+package zone
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultRecords are the static records of a zone without configured records.
+var DefaultRecords = []string{
+	"@ A 128.140.37.196",
+	"@ AAAA 2a01:4f8:1c0c:68c1::1",
+	"www A 128.140.37.196",
+	"www AAAA 2a01:4f8:1c0c:68c1::1",
+}
+
+// Records are the static records of a zone like the apex addresses, www and the glue of the nameservers.
+// The SOA and NS records are built from the zone, room and node names are dynamic.
+type Records struct {
+	byName map[string]map[uint16][]dns.RR
+}
+
+func NewRecords() *Records {
+	return &Records{byName: make(map[string]map[uint16][]dns.RR)}
+}
+
+// ParseRecords parses records in master file format (RFC 1035), one per line. Relative names are
+// relative to the apex of z and records without TTL get ttl.
+func (z *Zone) ParseRecords(lines []string, ttl uint32) (*Records, error) {
+	records := NewRecords()
+
+	// every line is parsed on its own, so a TTL does not carry over to the next records
+	for _, line := range lines {
+		if err := records.parse(z, strings.NewReader(line), "", ttl); err != nil {
+			return nil, err
+		}
+	}
+
+	return records, nil
+}
+
+// LoadFile adds the records of a master file (RFC 1035) like "zone.db", with $ORIGIN defaulting to
+// the apex of z and $TTL to ttl. The SOA and NS records of the apex are skipped,
+// since they are built from the zone config.
+func (r *Records) LoadFile(z *Zone, path string, ttl uint32) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open zone file: %v", err)
+	}
+	defer file.Close()
+
+	return r.parse(z, file, path, ttl)
+}
+
+func (r *Records) parse(z *Zone, reader io.Reader, file string, ttl uint32) error {
+	parser := dns.NewZoneParser(reader, z.Apex, file)
+	parser.SetDefaultTTL(ttl)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		hdr := rr.Header()
+		if file != "" && dns.CanonicalName(hdr.Name) == z.Apex && (hdr.Rrtype == dns.TypeSOA || hdr.Rrtype == dns.TypeNS) {
+			continue
+		}
+		if err := r.Add(z, rr); err != nil {
+			return err
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return fmt.Errorf("Failed to parse records of %s: %v", z.Apex, err)
+	}
+	return nil
+}
+
+// Add adds rr after checking that it is a static name of z.
+func (r *Records) Add(z *Zone, rr dns.RR) error {
+	hdr := rr.Header()
+	hdr.Name = dns.CanonicalName(hdr.Name)
+
+	if !z.Contains(hdr.Name) {
+		return fmt.Errorf("Record %s is not in zone %s", hdr.Name, z.Apex)
+	}
+	if name := z.Parse(hdr.Name); name.Kind == NameRoom || name.Kind == NameNode {
+		return fmt.Errorf("Record %s is in the dynamic room or node names", hdr.Name)
+	}
+	switch hdr.Rrtype {
+	case dns.TypeSOA, dns.TypeNS:
+		return fmt.Errorf("Record %s: SOA and NS records are built from the zone nameservers and hostmaster", hdr.Name)
+	}
+
+	if r.byName[hdr.Name] == nil {
+		r.byName[hdr.Name] = make(map[uint16][]dns.RR)
+	}
+	r.byName[hdr.Name][hdr.Rrtype] = append(r.byName[hdr.Name][hdr.Rrtype], rr)
+	return nil
+}
+
+// Get returns copies of the records of name with the given type.
+func (r *Records) Get(name string, qtype uint16) []dns.RR {
+	if r == nil {
+		return nil
+	}
+
+	var records []dns.RR
+	for _, rr := range r.byName[dns.CanonicalName(name)][qtype] {
+		records = append(records, dns.Copy(rr))
+	}
+	return records
+}
+
+// Answer returns the records of name with the given type, if name is a CNAME it returns
+// the CNAME and the records of its target in the zone.
+func (r *Records) Answer(name string, qtype uint16) []dns.RR {
+	if qtype == dns.TypeCNAME {
+		return r.Get(name, qtype)
+	}
+
+	if cname := r.Get(name, dns.TypeCNAME); len(cname) > 0 {
+		return append(cname, r.Get(cname[0].(*dns.CNAME).Target, qtype)...)
+	}
+	return r.Get(name, qtype)
+}
+
+// Exists reports whether name has records or is an empty non-terminal above records.
+func (r *Records) Exists(name string) bool {
+	if r == nil {
+		return false
+	}
+
+	name = dns.CanonicalName(name)
+	for owner := range r.byName {
+		if dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// Types returns the types of the records of name.
+func (r *Records) Types(name string) []uint16 {
+	if r == nil {
+		return nil
+	}
+
+	var types []uint16
+	for rrtype := range r.byName[dns.CanonicalName(name)] {
+		types = append(types, rrtype)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// All returns all records sorted by owner name and type.
+func (r *Records) All() []dns.RR {
+	if r == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var records []dns.RR
+	for _, name := range names {
+		for _, rrtype := range r.Types(name) {
+			records = append(records, r.Get(name, rrtype)...)
+		}
+	}
+	return records
+}
@@ -0,0 +1,164 @@
+package zone
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultNameserver = "pathfinderbeacon-ns1.heidenstedt.org."
+	DefaultHostmaster = "hostmaster-pathfinderbeacon-net.heidenstedt.org."
+)
+
+// Zone is a single apex the server is authoritative for.
+// The room, node and auth sub-zones are derived from the apex.
+type Zone struct {
+	Apex        string
+	RoomSuffix  string
+	NodeSuffix  string
+	AuthSuffix  string
+	Nameservers []string
+	Hostmaster  string
+
+	records atomic.Pointer[Records] // static records, replaced on reload
+}
+
+func New(apex string, nameservers []string, hostmaster string) *Zone {
+	apex = dns.CanonicalName(apex)
+
+	if len(nameservers) == 0 {
+		nameservers = []string{DefaultNameserver}
+	}
+	for i, ns := range nameservers {
+		nameservers[i] = dns.CanonicalName(ns)
+	}
+	if hostmaster == "" {
+		hostmaster = DefaultHostmaster
+	}
+
+	return &Zone{
+		Apex:        apex,
+		RoomSuffix:  "room." + apex,
+		NodeSuffix:  "node." + apex,
+		AuthSuffix:  "auth." + apex,
+		Nameservers: nameservers,
+		Hostmaster:  dns.CanonicalName(hostmaster),
+	}
+}
+
+// Records returns the static records of the zone, nil if there are none.
+func (z *Zone) Records() *Records {
+	return z.records.Load()
+}
+
+// SetRecords replaces the static records of the zone, e.g. after the zone file changed.
+func (z *Zone) SetRecords(records *Records) {
+	z.records.Store(records)
+}
+
+// Contains reports whether qName is the apex or below it.
+func (z *Zone) Contains(qName string) bool {
+	return dns.IsSubDomain(z.Apex, dns.CanonicalName(qName))
+}
+
+// Zones is the set of zones served, the most specific apex is matched first.
+type Zones struct {
+	list []*Zone
+}
+
+func NewZones(zones ...*Zone) *Zones {
+	list := append([]*Zone(nil), zones...)
+	sort.SliceStable(list, func(i, j int) bool {
+		return dns.CountLabel(list[i].Apex) > dns.CountLabel(list[j].Apex)
+	})
+	return &Zones{list: list}
+}
+
+// FromApexes creates zones sharing the same nameservers and hostmaster.
+func FromApexes(apexes []string, nameservers []string, hostmaster string) *Zones {
+	zones := make([]*Zone, 0, len(apexes))
+	for _, apex := range apexes {
+		apex = strings.TrimSpace(apex)
+		if apex == "" {
+			continue
+		}
+		zones = append(zones, New(apex, append([]string(nil), nameservers...), hostmaster))
+	}
+	return NewZones(zones...)
+}
+
+// Match returns the zone that is authoritative for qName or nil.
+func (z *Zones) Match(qName string) *Zone {
+	for _, zone := range z.list {
+		if zone.Contains(qName) {
+			return zone
+		}
+	}
+	return nil
+}
+
+func (z *Zones) List() []*Zone {
+	return z.list
+}
+
+type NameKind int
+
+const (
+	NameOther NameKind = iota // a name in the zone that is not a room, node or auth name
+	NameApex
+	NameRoom // <id>.room.<zone> and names below it
+	NameNode // <id>.node.<zone> and names below it
+	NameAuth // names below auth.<zone>
+)
+
+// Name is a query name split into its parts relative to the zone.
+// For "_http._tcp.<id>.room.<zone>" the kind is NameRoom, the ID is <id> and Labels are ["_http", "_tcp"].
+type Name struct {
+	Kind   NameKind
+	ID     string
+	Labels []string
+}
+
+// Parse splits qName, which has to be in the zone, into its parts.
+func (z *Zone) Parse(qName string) Name {
+	qName = dns.CanonicalName(qName)
+
+	if qName == z.Apex {
+		return Name{Kind: NameApex}
+	}
+
+	for _, sub := range []struct {
+		suffix string
+		kind   NameKind
+	}{
+		{z.RoomSuffix, NameRoom},
+		{z.NodeSuffix, NameNode},
+		{z.AuthSuffix, NameAuth},
+	} {
+		if !strings.HasSuffix(qName, "."+sub.suffix) {
+			continue
+		}
+
+		labels := dns.SplitDomainName(strings.TrimSuffix(qName, "."+sub.suffix))
+		return Name{
+			Kind:   sub.kind,
+			ID:     labels[len(labels)-1],
+			Labels: labels[:len(labels)-1],
+		}
+	}
+
+	return Name{Kind: NameOther}
+}
+
+// RoomName returns the fully qualified name of a room in this zone.
+func (z *Zone) RoomName(id string) string {
+	return id + "." + z.RoomSuffix
+}
+
+// NodeName returns the fully qualified name of a node in this zone.
+func (z *Zone) NodeName(id string) string {
+	return id + "." + z.NodeSuffix
+}